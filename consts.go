@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import ibus "github.com/untillpro/airs-ibus"
+
+// pattern segment kinds in the order of matching priority
+const (
+	segmentStatic segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+const (
+	ctxKeyRoute ctxKey = iota
+	ctxKeySpan
+	ctxKeyRemoteSpanContext
+	ctxKeyCodec
+	ctxKeyTimeouts
+)
+
+const (
+	resourceSeparator = "/"
+	wildcardSegment   = "*"
+)
+
+// content types of built-in codecs
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgPack = "application/msgpack"
+	ContentTypeCBOR    = "application/cbor"
+)
+
+const (
+	acceptHeader   = "Accept"
+	anyMediaRange  = "*/*"
+	qualityParam   = "q"
+	defaultQuality = 1.0
+	jsonStructTag  = "json"
+)
+
+// codes of errors returned by the bus as *BusError
+const (
+	ErrorCodeBusTimeout             = "bus_timeout"
+	ErrorCodeNoConsumer             = "no_consumer"
+	ErrorCodeBusBusy                = "bus_busy"
+	ErrorCodeBusOverloaded          = "bus_overloaded"
+	ErrorCodeBusClosed              = "bus_closed"
+	ErrorCodeStreamDeadlineExceeded = "stream_deadline_exceeded"
+	ErrorCodeLimitExceeded          = "limit_exceeded"
+	ErrorCodeResponseTooLarge       = "response_too_large"
+	ErrorCodeStreamAbandoned        = "stream_abandoned"
+	ErrorCodeProtocolViolation      = "protocol_violation"
+	ErrorCodeHandlerPanic           = "handler_panic"
+	ErrorCodeInternal               = "internal"
+)
+
+// pooled element buffers
+const (
+	elementBufferInlineSize    = 64
+	maxPooledElementBufferSize = 64 * 1024
+)
+
+// adaptive concurrency limit is multiplied by this factor when the latency exceeds the target
+const admissionBackoffFactor = 0.9
+
+const metricsPrefix = "ibusmem_"
+
+// histogram buckets upper bounds, in seconds
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+var sectionKindLabels = map[ibus.SectionKind]string{
+	ibus.SectionKindUnspecified: "unspecified",
+	ibus.SectionKindArray:       "array",
+	ibus.SectionKindMap:         "map",
+	ibus.SectionKindObject:      "object",
+}
+
+// W3C Trace Context header, see https://www.w3.org/TR/trace-context/#traceparent-header
+const (
+	traceParentHeader  = "traceparent"
+	traceParentVersion = "00"
+	traceFlagSampled   = 0x01
+)
+
+// span names
+const (
+	spanRequest  = "ibus.SendRequest2"
+	spanStream   = "ibus.ParallelResponse"
+	spanSection  = "ibus.Section"
+	eventClose   = "close"
+	eventRespond = "response"
+)
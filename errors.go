@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"errors"
+	"net/http"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+var (
+	// returned by SendRequest2 if the partition queue of the worker pool is full
+	ErrBusBusy = errors.New("bus busy")
+
+	// returned by SendRequest2 along with AdmissionControl.OverloadResponse if the request is rejected by the admission control
+	ErrBusOverloaded = errors.New("bus overloaded")
+
+	// returned by SendRequest2 once the bus shutdown is started
+	// returned by section and element sends once in-flight requests are cancelled by the bus shutdown
+	ErrBusClosed = errors.New("bus closed")
+
+	// set as the cause of requestCtx once the client ctx is done, e.g. the client is disconnected, see context.Cause
+	ErrClientDisconnected = errors.New("client disconnected")
+
+	// returned by CollectSections if the collected document exceeds the size limit
+	ErrResponseTooLarge = errors.New("response too large")
+
+	// set as the sectioned response error and returned by section and element sends once Timeouts.Stream is exceeded
+	ErrStreamDeadlineExceeded = errors.New("stream deadline exceeded")
+
+	// returned by section and element sends if the section or the element exceeds Limits of the bus
+	ErrLimitExceeded = errors.New("limit exceeded")
+
+	// returned by senders in the safe mode on misuse, e.g. on the element send before the section start or on sends after Close
+	// the misuse panics if the safe mode is off, see WithSafeMode
+	ErrProtocolViolation = errors.New("protocol violation")
+
+	// set as the sectioned response error and returned by section and element sends once the stream is closed by WithLeakDetection
+	ErrStreamAbandoned = errors.New("stream abandoned")
+)
+
+// statuses and codes of errors which are wrapped into *BusError by the bus
+var busErrors = []BusError{
+	{Status: http.StatusServiceUnavailable, Code: ErrorCodeBusTimeout, cause: ibus.ErrBusTimeoutExpired},
+	{Status: http.StatusRequestTimeout, Code: ErrorCodeNoConsumer, cause: ibus.ErrNoConsumer},
+	{Status: http.StatusServiceUnavailable, Code: ErrorCodeBusBusy, cause: ErrBusBusy},
+	{Status: http.StatusServiceUnavailable, Code: ErrorCodeBusOverloaded, cause: ErrBusOverloaded},
+	{Status: http.StatusServiceUnavailable, Code: ErrorCodeBusClosed, cause: ErrBusClosed},
+	{Status: http.StatusGatewayTimeout, Code: ErrorCodeStreamDeadlineExceeded, cause: ErrStreamDeadlineExceeded},
+	{Status: http.StatusRequestEntityTooLarge, Code: ErrorCodeLimitExceeded, cause: ErrLimitExceeded},
+	{Status: http.StatusRequestEntityTooLarge, Code: ErrorCodeResponseTooLarge, cause: ErrResponseTooLarge},
+	{Status: http.StatusInternalServerError, Code: ErrorCodeStreamAbandoned, cause: ErrStreamAbandoned},
+	{Status: http.StatusInternalServerError, Code: ErrorCodeProtocolViolation, cause: ErrProtocolViolation},
+}
@@ -1,15 +1,21 @@
 module github.com/untillpro/ibusmem
 
-go 1.21.4
+go 1.23.0
 
 toolchain go1.23.4
 
 require (
+	github.com/fxamacker/cbor/v2 v2.9.2
 	github.com/stretchr/testify v1.9.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	github.com/voedger/voedger v1.202405300917.1
 )
 
-require github.com/robfig/cron/v3 v3.0.0 // indirect
+require (
+	github.com/robfig/cron/v3 v3.0.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
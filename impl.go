@@ -6,82 +6,172 @@ package ibusmem
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/voedger/voedger/pkg/goutils/logger"
 	"github.com/untillpro/airs-ibus"
 )
 
+// timeout is used for the response, section and element waits which are not configured by WithTimeouts or ContextWithTimeouts
 // if ctx.Done() and SendParallelResponse simultaneously then return sections channel + err = ctx.Err()
 // nobody reads the sections channel in this case (according to the IBus contract) so `case ctx.Done()` in trySendSection() will fire for sure
 func (b *bus) SendRequest2(clientCtx context.Context, request ibus.Request, timeout time.Duration) (res ibus.Response, sections <-chan ibus.ISection, secError *error, err error) {
+	b.metrics.Request()
+	start := b.clock.Now()
+	defer func() {
+		b.requestFinished(start, err)
+	}()
+	scope, requestCtx, err := b.enter(clientCtx)
+	if err != nil {
+		return res, nil, nil, toBusError(err)
+	}
+	defer scope.release()
+	handlerDone := scope.release
+	requestCtx, endSpan := b.startRequestSpan(requestCtx, request)
+	defer func() {
+		endSpan(err)
+	}()
+	codec := b.negotiateCodec(request.Header)
+	requestCtx = context.WithValue(requestCtx, ctxKeyCodec, codec)
+	b.onRequest(requestCtx, request)
+	defer func() {
+		b.onRequestDone(requestCtx, request, res, err)
+	}()
+	res, releaseAdmission, err := b.admit(clientCtx)
+	if err != nil {
+		handlerDone()
+		return res, nil, nil, toBusError(err)
+	}
+	defer releaseAdmission()
 	wg := sync.WaitGroup{}
-	handlerPanic := make(chan interface{}, 1)
+	handlerPanic := make(chan *PanicError, 1)
+	timeouts := b.requestTimeouts(clientCtx, timeout)
 	s := &channelSender{
-		c:         make(chan interface{}, 1),
-		timeout:   timeout,
-		clientCtx: clientCtx,
+		c:          make(chan interface{}, 1),
+		request:    request,
+		logger:     b.logger,
+		safeMode:   b.safeMode,
+		timeouts:   timeouts,
+		clientCtx:  clientCtx,
+		requestCtx: requestCtx,
+		scope:      scope,
+		codec:      codec,
+	}
+	sender := NewISender(b, s)
+	handle := func() {
+		defer handlerDone()
+		b.handle(requestCtx, sender, request, handlerPanic)
 	}
+	if b.workerPool != nil {
+		if err = b.submit(requestCtx, request, handle, handlerDone); err != nil {
+			handlerDone()
+			return res, nil, nil, toBusError(err)
+		}
+	}
+	responseTimer := b.clock.NewTimer(timeouts.Response)
+	defer responseTimer.Stop()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		select {
-		case result := <-s.c:
-			switch result := result.(type) {
-			case ibus.Response:
-				res = result
-			case *resultSenderClosable:
-				rsender := result
-				sections = rsender.sections
-				secError = rsender.err
-			}
-			err = clientCtx.Err() // to make ctx.Done() take priority
-		case <-clientCtx.Done():
-			if err = checkPanic(handlerPanic); err == nil {
-				err = clientCtx.Err()
-			}
-		case <-b.timerResponse(timeout):
-			if err = checkPanic(handlerPanic); err == nil {
-				err = ibus.ErrBusTimeoutExpired
-			}
-		case rIntf := <-handlerPanic:
-			err = handlePanic(rIntf)
-		}
-	}()
-	sender := NewISender(b, s)
-	func() {
-		defer func() {
-			if r := recover(); r != nil {
-				logger.Error("handler panic:", fmt.Sprint(r), "\n", string(debug.Stack()))
-				// will process panic in the goroutine instead of update err here to avoid data race
-				// https://dev.untill.com/projects/#!607751
-				handlerPanic <- r
-			}
-		}()
-		b.requestHandler(clientCtx, sender, request)
+		res, sections, secError, err = b.awaitResponse(s, responseTimer, handlerPanic)
 	}()
+	if b.workerPool == nil {
+		handle()
+	}
 	wg.Wait()
 	return res, sections, secError, err
 }
 
-func handlePanic(r interface{}) error {
-	switch rTyped := r.(type) {
-	case string:
-		return errors.New(rTyped)
-	case error:
-		return rTyped
-	default:
-		// notest
-		return fmt.Errorf("%#v", r)
+func (b *bus) requestFinished(start time.Time, err error) {
+	if errors.Is(err, ibus.ErrBusTimeoutExpired) {
+		b.metrics.BusTimeout()
 	}
+	b.metrics.RequestDuration(b.clock.Now().Sub(start))
 }
 
-func checkPanic(ch <-chan interface{}) error {
+// returns the overload response along with ErrBusOverloaded if the request is rejected
+// release must be called once the request is finished
+func (b *bus) admit(clientCtx context.Context) (res ibus.Response, release func(), err error) {
+	if b.admission == nil {
+		return res, func() {}, nil
+	}
+	if err = b.admission.acquire(clientCtx, b.clock); err != nil {
+		if err == ErrBusOverloaded {
+			res = *b.admission.cfg.OverloadResponse
+		}
+		return res, nil, err
+	}
+	admitted := b.clock.Now()
+	return res, func() {
+		b.admission.release(b.clock.Now().Sub(admitted))
+	}, nil
+}
+
+// the handler is not called if the request is finished already once the worker is free
+func (b *bus) submit(requestCtx context.Context, request ibus.Request, handle func(), handlerDone func()) error {
+	return b.workerPool.submit(request, func() {
+		if requestCtx.Err() != nil { // the client does not wait for the response already or the bus is closed
+			handlerDone()
+			return
+		}
+		handle()
+	})
+}
+
+// the panic is sent to handlerPanic to be processed by awaitResponse
+func (b *bus) handle(requestCtx context.Context, sender ibus.ISender, request ibus.Request, handlerPanic chan<- *PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{
+				Value:   r,
+				Stack:   debug.Stack(),
+				Request: request,
+			}
+			b.logger.Error("handler panic:", fmt.Sprint(r), "\n", string(panicErr.Stack))
+			b.metrics.Panic()
+			b.onPanic(requestCtx, panicErr)
+			// will process panic in the goroutine instead of update err here to avoid data race
+			// https://dev.untill.com/projects/#!607751
+			handlerPanic <- panicErr
+		}
+	}()
+	b.requestHandler(requestCtx, sender, request)
+}
+
+func (b *bus) awaitResponse(s *channelSender, responseTimer ITimer, handlerPanic <-chan *PanicError) (res ibus.Response, sections <-chan ibus.ISection, secError *error, err error) {
+	select {
+	case result := <-s.c:
+		switch result := result.(type) {
+		case ibus.Response:
+			res = result
+		case *resultSenderClosable:
+			rsender := result
+			sections = rsender.sections
+			secError = rsender.err
+		}
+		err = s.clientCtx.Err() // to make ctx.Done() take priority
+	case <-s.clientCtx.Done():
+		if err = checkPanic(handlerPanic); err == nil {
+			err = s.clientCtx.Err()
+		}
+	case <-responseTimer.C():
+		if err = checkPanic(handlerPanic); err == nil {
+			err = toBusError(ibus.ErrBusTimeoutExpired)
+			s.scope.cancel(err) // the client does not wait for the response already
+		}
+	case panicErr := <-handlerPanic:
+		err = handlePanic(panicErr)
+	case <-b.lifecycle.stop:
+		err = toBusError(ErrBusClosed)
+	}
+	return res, sections, secError, err
+}
+
+func checkPanic(ch <-chan *PanicError) error {
 	select {
 	case r := <-ch:
 		return handlePanic(r)
@@ -92,21 +182,71 @@ func checkPanic(ch <-chan interface{}) error {
 
 func (b *bus) SendResponse(sender interface{}, response ibus.Response) {
 	s := sender.(*channelSender)
+	if s.respond() != nil {
+		return
+	}
 	s.send(response)
+	b.metrics.Response()
+	if span, ok := SpanFromContext(s.requestCtx); ok {
+		span.AddEvent(eventRespond, Attribute{Key: "ibus.status_code", Value: strconv.Itoa(response.StatusCode)})
+	}
 }
 
 func (b *bus) SendParallelResponse2(sender interface{}) (rsender ibus.IResultSenderClosable) {
 	s := sender.(*channelSender)
+	if err := s.respond(); err != nil {
+		return &violatedSender{err: err}
+	}
 	var err error
-	rsender = &resultSenderClosable{
-		sections:     make(chan ibus.ISection),
-		err:          &err,
-		timeout:      s.timeout,
-		clientCtx:    s.clientCtx,
-		timerSection: b.timerSection,
-		timerElement: b.timerElement,
-	}
-	s.send(rsender)
+	buffer := 0
+	if b.flowControl != nil {
+		buffer = b.flowControl.WindowElements
+	}
+	rs := &resultSenderClosable{
+		sections:   make(chan ibus.ISection, buffer),
+		err:        &err,
+		timeouts:   s.timeouts,
+		clientCtx:  s.clientCtx,
+		clock:      b.clock,
+		deadlines:  b.deadlines,
+		metrics:    b.metrics,
+		started:    b.clock.Now(),
+		tracer:     b.tracer,
+		stop:       b.lifecycle.stop,
+		codec:      s.codec,
+		buffer:     buffer,
+		requestCtx: s.requestCtx,
+		request:    s.request,
+		logger:     b.logger,
+		safeMode:   b.safeMode,
+		hooks:      b.hooks,
+		limits:     b.limits,
+	}
+	if b.flowControl != nil && b.flowControl.WindowBytes > 0 {
+		rs.window = newFlowWindow(b.flowControl.WindowBytes)
+	}
+	if b.batching != nil {
+		rs.batcher = &elementBatcher{cfg: *b.batching}
+	}
+	if s.scope.retain() {
+		rs.scope = s.scope
+	}
+	if b.tracer != nil {
+		rs.streamCtx, rs.streamSpan = b.tracer.Start(s.requestCtx, spanStream)
+	}
+	// timers close the stream concurrently, so they are started under the stream lock once the stream is set up
+	rsender = rs
+	rs.Lock()
+	if b.leakDetection != nil {
+		rsender = rs.track(b.leakDetection)
+	}
+	if rs.timeouts.Stream > 0 {
+		rs.deadlineExceeded = make(chan struct{})
+		rs.deadline = b.clock.AfterFunc(rs.timeouts.Stream, rs.expire)
+	}
+	rs.Unlock()
+	s.send(rs)
+	b.metrics.ParallelResponse()
 	return rsender
 }
 
@@ -116,131 +256,276 @@ func (s *channelSender) send(value interface{}) {
 }
 
 func (s *resultSenderClosable) StartArraySection(sectionType string, path []string) {
-	s.currentSection = arraySection{
+	s.Lock()
+	defer s.Unlock()
+	defer s.touch()
+	if s.closedByBus() != nil {
+		return
+	}
+	if s.closed {
+		s.violation("section is started after Close")
+		return
+	}
+	s.sectionKind, s.sectionType = ibus.SectionKindArray, sectionType
+	s.startSectionSpan(ibus.SectionKindArray, sectionType, path)
+	elems, batches := s.updateElemsChannel()
+	s.currentSection = &arraySection{
 		sectionType: sectionType,
 		path:        path,
-		elems:       s.updateElemsChannel(),
+		elems:       elems,
+		batches:     batches,
+		window:      s.window,
+		codec:       s.codec,
+		released:    &s.released,
 	}
 }
 
 func (s *resultSenderClosable) StartMapSection(sectionType string, path []string) {
-	s.currentSection = mapSection{
+	s.Lock()
+	defer s.Unlock()
+	defer s.touch()
+	if s.closedByBus() != nil {
+		return
+	}
+	if s.closed {
+		s.violation("section is started after Close")
+		return
+	}
+	s.sectionKind, s.sectionType = ibus.SectionKindMap, sectionType
+	s.startSectionSpan(ibus.SectionKindMap, sectionType, path)
+	elems, batches := s.updateElemsChannel()
+	s.currentSection = &mapSection{
 		sectionType: sectionType,
 		path:        path,
-		elems:       s.updateElemsChannel(),
+		elems:       elems,
+		batches:     batches,
+		window:      s.window,
+		codec:       s.codec,
+		released:    &s.released,
 	}
 }
 
 func (s *resultSenderClosable) ObjectSection(sectionType string, path []string, element interface{}) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	defer s.touch()
+	if err = s.closedByBus(); err != nil {
+		return toBusError(err)
+	}
+	if s.closed {
+		return s.violation("section is sent after Close")
+	}
+	s.sectionKind, s.sectionType = ibus.SectionKindObject, sectionType
+	s.startSectionSpan(ibus.SectionKindObject, sectionType, path)
+	elems, _ := s.updateElemsChannel()
 	s.currentSection = &objectSection{
 		sectionType: sectionType,
 		path:        path,
-		elements:    s.updateElemsChannel(),
+		elements:    elems,
+		window:      s.window,
+		codec:       s.codec,
+		released:    &s.released,
 	}
-	err = s.SendElement("", element)
+	err = s.sendElement("", element)
 	s.elements = nil
-	return
+	s.endSectionSpan()
+	return toBusError(err)
 }
 
 func (s *resultSenderClosable) SendElement(name string, el interface{}) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	defer s.touch()
+	if err = s.closedByBus(); err != nil {
+		return toBusError(err)
+	}
+	if s.closed {
+		return s.violation("element is sent after Close")
+	}
+	return toBusError(s.sendElement(name, el))
+}
+
+func (s *resultSenderClosable) sendElement(name string, el interface{}) (err error) {
 	if el == nil {
 		return nil
 	}
 	if s.elements == nil {
-		panic("section is not started")
+		return s.violation("section is not started")
 	}
+	defer func() {
+		s.traceElement(err)
+	}()
+	var buf *elementBuffer
 	bb, ok := el.([]byte)
 	if !ok {
-		if bb, err = json.Marshal(el); err != nil {
+		if bb, buf, err = s.encode(el); err != nil {
 			return
 		}
 	}
-	if err = s.tryToSendSection(); err != nil {
+	if err = s.checkElementSize(len(bb)); err == nil {
+		err = s.tryToSendSection()
+	}
+	if err != nil {
+		if buf != nil {
+			releaseElementBuffer(buf)
+		}
 		return
 	}
 	element := element{
 		name:  name,
 		value: bb,
+		buf:   buf,
+	}
+	if s.batcher != nil && s.sectionKind != ibus.SectionKindObject {
+		return s.batchElement(element)
+	}
+	if err = s.tryToSendElement(element); err == nil {
+		s.metrics.Element(s.sectionKind, s.sectionType)
 	}
-	return s.tryToSendElement(element)
+	return err
 }
 
+// the stream closed by the bus already, e.g. by the deadline, is not closed again
 func (s *resultSenderClosable) Close(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closedByBus() != nil {
+		return
+	}
+	if s.closed {
+		s.violation("stream is closed already")
+		return
+	}
+	s.close(err)
+}
+
+// metrics and spans are done before the sections channel is closed to be visible for the client once it reads all sections
+// must be called under the stream lock
+func (s *resultSenderClosable) close(err error) {
+	s.closed = true
+	if s.deadline != nil {
+		s.deadline.Stop()
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.closeBatches()
+	s.metrics.StreamDuration(s.clock.Now().Sub(s.started))
+	s.traceClose(err)
+	s.onStreamClose(err)
 	*s.err = err
+	s.releaseEncoder()
+	s.stopTimeout()
 	close(s.sections)
 	if s.elements != nil {
 		close(s.elements)
 	}
+	if s.scope != nil {
+		s.scope.release()
+		s.scope = nil
+	}
 }
 
-func (s *resultSenderClosable) updateElemsChannel() chan element {
+// batches of the previous section are delivered before its elements channel is closed
+func (s *resultSenderClosable) updateElemsChannel() (elems chan element, batches chan []element) {
+	if s.batcher != nil {
+		batches = s.startBatches()
+	}
 	if s.elements != nil {
 		close(s.elements)
 	}
-	s.elements = make(chan element)
-	return s.elements
+	s.elements = make(chan element, s.buffer)
+	return s.elements, batches
 }
 
+// the non-blocking send is tried first to detect if the producer is blocked by the client
 func (s *resultSenderClosable) tryToSendSection() (err error) {
 	if s.currentSection != nil {
+		if err = s.checkSectionsAmount(); err != nil {
+			return err
+		}
 		select {
 		case s.sections <- s.currentSection:
-			s.currentSection = nil
-			return s.clientCtx.Err() // ctx.Done() has priority on simultaneous (s.ctx.Done() and s.sections<- success)
-		case <-s.clientCtx.Done():
-			return s.clientCtx.Err()
-		case <-s.timerSection(s.timeout):
-			return ibus.ErrNoConsumer
+		default:
+			s.metrics.ProducerBlocked(s.sectionKind, s.sectionType)
+			defer s.stopTimeout()
+			select {
+			case s.sections <- s.currentSection:
+			case <-s.clientCtx.Done():
+				return s.clientCtx.Err()
+			case <-s.sectionTimeout():
+				s.metrics.NoConsumer()
+				return ibus.ErrNoConsumer
+			case <-s.stop:
+				return ErrBusClosed
+			case <-s.deadlineExceeded:
+				return ErrStreamDeadlineExceeded
+			}
 		}
+		s.currentSection = nil
+		s.sentSections++
+		s.metrics.Section(s.sectionKind, s.sectionType)
+		return s.clientCtx.Err() // ctx.Done() has priority on simultaneous (s.ctx.Done() and s.sections<- success)
 	}
 	return nil
 }
 
 func (s *resultSenderClosable) tryToSendElement(value element) (err error) {
+	if err = s.acquireWindow(len(value.value), s.sectionKind, s.sectionType); err != nil {
+		return err
+	}
 	select {
 	case s.elements <- value:
 		return s.clientCtx.Err() // ctx.Done() has priority on simultaneous (s.ctx.Done() and s.elemets<- success)
-	case <-s.clientCtx.Done():
+	default:
+		s.metrics.ProducerBlocked(s.sectionKind, s.sectionType)
+	}
+	defer s.stopTimeout()
+	select {
+	case s.elements <- value:
 		return s.clientCtx.Err()
-	case <-s.timerElement(s.timeout):
-		return ibus.ErrNoConsumer
+	case <-s.clientCtx.Done():
+		err = s.clientCtx.Err()
+	case <-s.elementTimeout():
+		s.metrics.NoConsumer()
+		err = ibus.ErrNoConsumer
+	case <-s.stop:
+		err = ErrBusClosed
+	case <-s.deadlineExceeded:
+		err = ErrStreamDeadlineExceeded
 	}
+	s.window.release(len(value.value))
+	return err
 }
 
-func (s arraySection) Type() string {
+func (s *arraySection) Type() string {
 	return s.sectionType
 }
 
-func (s arraySection) Path() []string {
+func (s *arraySection) Path() []string {
 	return s.path
 }
 
-func (s arraySection) Next(ctx context.Context) (value []byte, ok bool) {
-	select {
-	case e, ok := <-s.elems:
-		if ok && ctx.Err() == nil {
-			return e.value, true
-		}
-	case <-ctx.Done():
+func (s *arraySection) Next(ctx context.Context) (value []byte, ok bool) {
+	if e, ok := receiveElement(ctx, s.elems, s.batches, &s.pending, s.window); ok {
+		s.last = e.buf
+		return e.value, true
 	}
 	return nil, false
 }
 
-func (s mapSection) Type() string {
+func (s *mapSection) Type() string {
 	return s.sectionType
 }
 
-func (s mapSection) Path() []string {
+func (s *mapSection) Path() []string {
 	return s.path
 }
 
-func (s mapSection) Next(ctx context.Context) (name string, value []byte, ok bool) {
-	select {
-	case e, ok := <-s.elems:
-		if ok && ctx.Err() == nil {
-			return e.name, e.value, true
-		}
-	case <-ctx.Done():
+func (s *mapSection) Next(ctx context.Context) (name string, value []byte, ok bool) {
+	if e, ok := receiveElement(ctx, s.elems, s.batches, &s.pending, s.window); ok {
+		s.last = e.buf
+		return e.name, e.value, true
 	}
 	return "", nil, false
 }
@@ -257,8 +542,12 @@ func (s *objectSection) Value(ctx context.Context) []byte {
 	if !s.elementReceived {
 		select {
 		case e, ok := <-s.elements:
+			if ok {
+				s.window.release(len(e.value))
+			}
 			if ok && ctx.Err() == nil {
 				s.elementReceived = true
+				s.last = e.buf
 				return e.value
 			}
 		case <-ctx.Done():
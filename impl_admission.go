@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"time"
+)
+
+// returns ErrBusOverloaded if no in-flight slot is got during AdmissionControl.MaxQueueWait
+// slots are granted to waiters in FIFO order
+func (a *admission) acquire(clientCtx context.Context, clock IClock) error {
+	a.Lock()
+	if a.inFlight < a.currentLimit() && len(a.waiters) == 0 {
+		a.inFlight++
+		a.Unlock()
+		return nil
+	}
+	if a.cfg.MaxQueueWait <= 0 {
+		a.Unlock()
+		return ErrBusOverloaded
+	}
+	granted := make(chan struct{})
+	a.waiters = append(a.waiters, granted)
+	a.Unlock()
+
+	timer := clock.NewTimer(a.cfg.MaxQueueWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-granted:
+		return nil
+	case <-timer.C():
+		err = ErrBusOverloaded
+	case <-clientCtx.Done():
+		err = clientCtx.Err()
+	}
+	a.Lock()
+	defer a.Unlock()
+	if !a.removeWaiter(granted) {
+		// the slot is granted simultaneously with the timeout -> give it back
+		a.inFlight--
+		a.grant()
+	}
+	return err
+}
+
+// latency is used to adjust the limit if the adaptive concurrency is enabled
+func (a *admission) release(latency time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	if a.cfg.TargetLatency > 0 {
+		if latency > a.cfg.TargetLatency {
+			a.limit *= admissionBackoffFactor
+		} else {
+			a.limit += 1 / a.limit // +1 per limit successful requests
+		}
+		a.limit = min(max(a.limit, float64(a.cfg.MinInFlight)), float64(a.cfg.MaxInFlight))
+	}
+	a.inFlight--
+	a.grant()
+}
+
+func (a *admission) currentLimit() int {
+	return int(a.limit)
+}
+
+func (a *admission) grant() {
+	for len(a.waiters) > 0 && a.inFlight < a.currentLimit() {
+		close(a.waiters[0])
+		a.waiters[0] = nil
+		a.waiters = a.waiters[1:]
+		a.inFlight++
+	}
+}
+
+func (a *admission) removeWaiter(waiter chan struct{}) bool {
+	for i, w := range a.waiters {
+		if w == waiter {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// handler of the returned bus blocks "blocker" requests until release is closed
+func provideBlockingBus(cfg AdmissionControl) (b ibus.IBus, started chan struct{}, release chan struct{}) {
+	started = make(chan struct{}, 1)
+	release = make(chan struct{})
+	b = Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "blocker" {
+			started <- struct{}{}
+			<-release
+		}
+		sender.SendResponse(ibus.Response{Data: []byte(request.Resource)})
+	}, WithAdmissionControl(cfg))
+	return b, started, release
+}
+
+func TestAdmissionControl_RejectImmediately(t *testing.T) {
+	require := require.New(t)
+	t.Run("Default overload response", func(t *testing.T) {
+		b, started, release := provideBlockingBus(AdmissionControl{MaxInFlight: 1})
+		blockerDone := make(chan struct{})
+		go func() {
+			defer close(blockerDone)
+			_, _, _, err := b.SendRequest2(context.Background(), ibus.Request{Resource: "blocker"}, ibus.DefaultTimeout)
+			require.NoError(err)
+		}()
+		<-started
+
+		resp, sections, secErr, err := b.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.ErrorIs(err, ErrBusOverloaded)
+		require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+		require.Nil(sections)
+		require.Nil(secErr)
+
+		close(release)
+		<-blockerDone
+
+		// slot is free now
+		resp, _, _, err = b.SendRequest2(context.Background(), ibus.Request{Resource: "ok"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("ok", string(resp.Data))
+	})
+	t.Run("Custom overload response", func(t *testing.T) {
+		overloadResp := ibus.CreateResponse(http.StatusTooManyRequests, "try later")
+		b, started, release := provideBlockingBus(AdmissionControl{MaxInFlight: 1, OverloadResponse: &overloadResp})
+		go b.SendRequest2(context.Background(), ibus.Request{Resource: "blocker"}, ibus.DefaultTimeout)
+		<-started
+
+		resp, _, _, err := b.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.ErrorIs(err, ErrBusOverloaded)
+		require.Equal(overloadResp, resp)
+		close(release)
+	})
+}
+
+func TestAdmissionControl_QueueWait(t *testing.T) {
+	require := require.New(t)
+	t.Run("Should wait for the free slot", func(t *testing.T) {
+		b, started, release := provideBlockingBus(AdmissionControl{MaxInFlight: 1, MaxQueueWait: ibus.DefaultTimeout})
+		go b.SendRequest2(context.Background(), ibus.Request{Resource: "blocker"}, ibus.DefaultTimeout)
+		<-started
+
+		waiterDone := make(chan struct{})
+		go func() {
+			defer close(waiterDone)
+			resp, _, _, err := b.SendRequest2(context.Background(), ibus.Request{Resource: "waiter"}, ibus.DefaultTimeout)
+			require.NoError(err)
+			require.Equal("waiter", string(resp.Data))
+		}()
+		a := b.(*bus).admission
+		require.Eventually(func() bool {
+			a.Lock()
+			defer a.Unlock()
+			return len(a.waiters) == 1
+		}, ibus.DefaultTimeout, time.Millisecond)
+		close(release)
+		<-waiterDone
+	})
+	t.Run("Should reject on queue wait timeout", func(t *testing.T) {
+		b, started, release := provideBlockingBus(AdmissionControl{MaxInFlight: 1, MaxQueueWait: time.Millisecond})
+		go b.SendRequest2(context.Background(), ibus.Request{Resource: "blocker"}, ibus.DefaultTimeout)
+		<-started
+
+		resp, _, _, err := b.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.ErrorIs(err, ErrBusOverloaded)
+		require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+		require.Empty(b.(*bus).admission.waiters)
+		close(release)
+	})
+	t.Run("Should return error on ctx done while waiting", func(t *testing.T) {
+		b, started, release := provideBlockingBus(AdmissionControl{MaxInFlight: 1, MaxQueueWait: ibus.DefaultTimeout})
+		go b.SendRequest2(context.Background(), ibus.Request{Resource: "blocker"}, ibus.DefaultTimeout)
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		resp, _, _, err := b.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		require.ErrorIs(err, context.Canceled)
+		require.Empty(resp)
+		close(release)
+	})
+}
+
+func TestAdmissionControl_Adaptive(t *testing.T) {
+	require := require.New(t)
+	a := &admission{
+		cfg:   AdmissionControl{MaxInFlight: 10, MinInFlight: 2, TargetLatency: time.Second},
+		limit: 10,
+	}
+	acquireRelease := func(latency time.Duration) {
+		require.NoError(a.acquire(context.Background(), SystemClock))
+		a.release(latency)
+	}
+
+	// slow requests -> limit decreases down to min
+	for i := 0; i < 100; i++ {
+		acquireRelease(2 * time.Second)
+	}
+	require.Equal(2, a.currentLimit())
+
+	// requests over the limit are rejected
+	require.NoError(a.acquire(context.Background(), SystemClock))
+	require.NoError(a.acquire(context.Background(), SystemClock))
+	require.ErrorIs(a.acquire(context.Background(), SystemClock), ErrBusOverloaded)
+	a.release(time.Millisecond)
+	a.release(time.Millisecond)
+
+	// fast requests -> limit increases up to max
+	for i := 0; i < 1000; i++ {
+		acquireRelease(time.Millisecond)
+	}
+	require.Equal(10, a.currentLimit())
+}
+
+func TestAdmissionControl_Options(t *testing.T) {
+	require := require.New(t)
+	require.Panics(func() { WithAdmissionControl(AdmissionControl{}) })
+	require.Panics(func() { WithAdmissionControl(AdmissionControl{MaxInFlight: 1, MinInFlight: 2}) })
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// the batch of the previous section is delivered before the new section is started
+// object section element is delivered as is, so there are no batches for the object section
+func (s *resultSenderClosable) startBatches() chan []element {
+	b := s.batcher
+	b.Lock()
+	defer b.Unlock()
+	s.flushBatch()
+	if b.batches != nil {
+		close(b.batches)
+		b.batches = nil
+	}
+	if s.sectionKind != ibus.SectionKindObject {
+		b.batches = make(chan []element, s.buffer)
+		b.sectionKind, b.sectionType = s.sectionKind, s.sectionType
+	}
+	return b.batches
+}
+
+func (s *resultSenderClosable) closeBatches() {
+	b := s.batcher
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	s.flushBatch()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.batches != nil {
+		close(b.batches)
+		b.batches = nil
+	}
+}
+
+func (s *resultSenderClosable) batchElement(e element) error {
+	b := s.batcher
+	b.Lock()
+	defer b.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.pending = append(b.pending, e)
+	b.pendingSize += len(e.value)
+	if len(b.pending) >= b.cfg.MaxElements || (b.cfg.MaxBytes > 0 && b.pendingSize >= b.cfg.MaxBytes) {
+		return s.flushBatch()
+	}
+	if len(b.pending) == 1 && b.cfg.MaxLatency > 0 {
+		if b.timer == nil {
+			b.timer = s.clock.AfterFunc(b.cfg.MaxLatency, s.flushBatchByTimer)
+		} else {
+			b.timer.Reset(b.cfg.MaxLatency)
+		}
+	}
+	return nil
+}
+
+// the delivery error is kept to be returned by the next SendElement
+func (s *resultSenderClosable) flushBatchByTimer() {
+	s.batcher.Lock()
+	defer s.batcher.Unlock()
+	s.flushBatch()
+}
+
+// must be called under the batcher lock
+func (s *resultSenderClosable) flushBatch() error {
+	b := s.batcher
+	if len(b.pending) == 0 {
+		return b.err
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	batch := b.pending
+	b.pending, b.pendingSize = nil, 0
+	if b.err != nil {
+		return b.err
+	}
+	if b.err = s.tryToSendBatch(batch); b.err != nil {
+		return b.err
+	}
+	for range batch {
+		s.metrics.Element(b.sectionKind, b.sectionType)
+	}
+	return nil
+}
+
+// must be called under the batcher lock
+func (s *resultSenderClosable) tryToSendBatch(batch []element) (err error) {
+	b := s.batcher
+	size := elementsSize(batch)
+	if err = s.acquireWindow(size, b.sectionKind, b.sectionType); err != nil {
+		return err
+	}
+	select {
+	case b.batches <- batch:
+		return s.clientCtx.Err() // ctx.Done() has priority on simultaneous (s.ctx.Done() and batches<- success)
+	default:
+		s.metrics.ProducerBlocked(b.sectionKind, b.sectionType)
+	}
+	defer s.stopTimeout()
+	select {
+	case b.batches <- batch:
+		return s.clientCtx.Err()
+	case <-s.clientCtx.Done():
+		err = s.clientCtx.Err()
+	case <-s.elementTimeout():
+		s.metrics.NoConsumer()
+		err = ibus.ErrNoConsumer
+	case <-s.stop:
+		err = ErrBusClosed
+	case <-s.deadlineExceeded:
+		err = ErrStreamDeadlineExceeded
+	}
+	s.window.release(size)
+	return err
+}
+
+// elements of the received batch are returned one by one before the next receive
+// received elements are returned to the bytes window of the producer
+// elements are delivered by batches only if batches are on, so the closed elements channel does not end the section while batches are buffered
+func receiveElement(ctx context.Context, elems <-chan element, batches <-chan []element, pending *[]element, window *flowWindow) (e element, ok bool) {
+	if batches != nil {
+		elems = nil
+	}
+	if len(*pending) > 0 {
+		e = (*pending)[0]
+		(*pending)[0] = element{}
+		*pending = (*pending)[1:]
+		return e, ctx.Err() == nil
+	}
+	select {
+	case e, ok = <-elems:
+		if ok {
+			window.release(len(e.value))
+		}
+	case batch, batchOk := <-batches:
+		if ok = batchOk; ok {
+			window.release(elementsSize(batch))
+			e, *pending = batch[0], batch[1:]
+		}
+	case <-ctx.Done():
+		return e, false
+	}
+	return e, ok && ctx.Err() == nil
+}
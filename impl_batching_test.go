@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestElementBatching_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	metrics := NewMetrics()
+	sent := make(chan struct{})
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			for i := 0; i < 7; i++ {
+				require.NoError(rs.SendElement("", i))
+				if i == 1 {
+					// the batch is not full so the elements are sent without waiting for the consumer
+					close(sent)
+				}
+			}
+			rs.StartMapSection("map", nil)
+			require.NoError(rs.SendElement("a", 1))
+			require.NoError(rs.SendElement("b", 2))
+			require.NoError(rs.ObjectSection("obj", nil, 42))
+			rs.StartArraySection("empty", nil)
+			rs.Close(nil)
+		}()
+	}, WithElementBatching(ElementBatching{MaxElements: 3}), WithMetrics(metrics))
+
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	arr := (<-sections).(ibus.IArraySection)
+	<-sent
+	got := []string{}
+	for value := range ArrayElements(ctx, arr) {
+		got = append(got, string(value))
+	}
+	require.Equal([]string{"0", "1", "2", "3", "4", "5", "6"}, got)
+
+	m := (<-sections).(ibus.IMapSection)
+	got = got[:0]
+	for name, value := range MapEntries(ctx, m) {
+		got = append(got, name+"="+string(value))
+	}
+	require.Equal([]string{"a=1", "b=2"}, got)
+
+	obj := (<-sections).(ibus.IObjectSection)
+	require.Equal("42", string(obj.Value(ctx)))
+
+	_, ok := <-sections
+	require.False(ok)
+	require.NoError(*secErr)
+
+	buf := bytes.Buffer{}
+	require.NoError(metrics.WriteText(&buf))
+	require.Contains(buf.String(), `ibusmem_elements_total{kind="array",type="arr"} 7`)
+	require.Contains(buf.String(), `ibusmem_elements_total{kind="map",type="map"} 2`)
+	require.Contains(buf.String(), `ibusmem_elements_total{kind="object",type="obj"} 1`)
+}
+
+func TestElementBatching_Thresholds(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		delivered := make(chan int, 10)
+		bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			rs := sender.SendParallelResponse()
+			go func() {
+				rs.StartArraySection("arr", nil)
+				for i := 0; i < 5; i++ {
+					require.NoError(rs.SendElement("", []byte(strings.Repeat("x", 4))))
+					delivered <- i
+				}
+				rs.Close(nil)
+			}()
+		}, WithElementBatching(ElementBatching{MaxElements: 100, MaxBytes: 8}))
+		_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		arr := (<-sections).(ibus.IArraySection)
+
+		// the first element is batched, the second one makes the batch full so SendElement waits for the consumer
+		require.Equal(0, <-delivered)
+		require.Never(func() bool { return len(delivered) > 0 }, 50*time.Millisecond, time.Millisecond)
+		amount := 0
+		for range ArrayElements(ctx, arr) {
+			amount++
+		}
+		require.Equal(5, amount)
+	})
+
+	t.Run("MaxLatency", func(t *testing.T) {
+		closeStream := make(chan struct{})
+		bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			rs := sender.SendParallelResponse()
+			go func() {
+				rs.StartMapSection("map", nil)
+				require.NoError(rs.SendElement("a", 1))
+				<-closeStream
+				require.NoError(rs.SendElement("b", 2))
+				rs.Close(nil)
+			}()
+		}, WithElementBatching(ElementBatching{MaxElements: 100, MaxLatency: 10 * time.Millisecond}))
+		_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		m := (<-sections).(ibus.IMapSection)
+
+		// delivered by the timer while the producer waits
+		name, value, ok := m.Next(ctx)
+		require.True(ok)
+		require.Equal("a", name)
+		require.Equal("1", string(value))
+
+		close(closeStream)
+		name, _, ok = m.Next(ctx)
+		require.True(ok)
+		require.Equal("b", name)
+		_, _, ok = m.Next(ctx)
+		require.False(ok)
+	})
+}
+
+func TestElementBatching_Errors(t *testing.T) {
+	require := require.New(t)
+	provideBus := func(sendErrs chan error, proceed <-chan struct{}, opts ...Option) ibus.IBus {
+		return Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			rs := sender.SendParallelResponse()
+			go func() {
+				defer close(sendErrs)
+				rs.StartArraySection("arr", nil)
+				sendErrs <- rs.SendElement("", 1)
+				<-proceed
+				sendErrs <- rs.SendElement("", 2)
+				rs.Close(nil)
+			}()
+		}, opts...)
+	}
+
+	t.Run("Should return the delivery error", func(t *testing.T) {
+		sendErrs := make(chan error, 2)
+		proceed := make(chan struct{})
+		close(proceed)
+		bus := provideBus(sendErrs, proceed, WithElementBatching(ElementBatching{MaxElements: 1}))
+		_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, 10*time.Millisecond)
+		require.NoError(err)
+		<-sections
+		require.ErrorIs(<-sendErrs, ibus.ErrNoConsumer)
+		require.ErrorIs(<-sendErrs, ibus.ErrNoConsumer)
+	})
+
+	t.Run("Should return the delivery error of the timer", func(t *testing.T) {
+		clock := NewManualClock(time.Now())
+		sendErrs := make(chan error, 2)
+		proceed := make(chan struct{})
+		bus := provideBus(sendErrs, proceed, WithClock(clock), WithElementBatching(ElementBatching{MaxElements: 100, MaxLatency: time.Second}))
+		_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, time.Minute)
+		require.NoError(err)
+		<-sections
+		require.NoError(<-sendErrs)
+
+		// the batch is delivered by the timer, the delivery waits for the consumer holding the batch
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		clock.BlockUntil(1)
+		close(proceed)
+		clock.Advance(time.Minute)
+		require.ErrorIs(<-sendErrs, ibus.ErrNoConsumer)
+	})
+
+	t.Run("Should panic on wrong config", func(t *testing.T) {
+		for _, cfg := range []ElementBatching{
+			{},
+			{MaxElements: 1, MaxBytes: -1},
+			{MaxElements: 1, MaxLatency: -1},
+		} {
+			require.Panics(func() { WithElementBatching(cfg) }, fmt.Sprint(cfg))
+		}
+	})
+}
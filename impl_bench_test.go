@@ -6,7 +6,10 @@ package ibusmem
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -112,3 +115,161 @@ func BenchmarkNonsectionedResponse(b *testing.B) {
 		b.ReportMetric(float64(b.N)/elapsed, "rps")
 	})
 }
+
+// elements of the consumer which does not release them are encoded by json.Marshal as before pooled buffers
+// released elements are encoded into pooled buffers, so the value is not allocated per element
+// BenchmarkSectionedRequestResponseEncoding/not_released     20000	    216070 ns/op	    462813 elements/s	    7728 B/op	     336 allocs/op
+// BenchmarkSectionedRequestResponseEncoding/released         20000	    201618 ns/op	    495988 elements/s	    6161 B/op	     238 allocs/op
+func BenchmarkSectionedRequestResponseEncoding(b *testing.B) {
+	const elements = 100
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("secArr", nil)
+			for i := 0; i < elements; i++ {
+				require.NoError(b, rs.SendElement("", testPoint{X: i, Y: i}))
+			}
+			rs.Close(nil)
+		}()
+	})
+
+	for _, release := range []bool{false, true} {
+		name := "not released"
+		if release {
+			name = "released"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				ctx := context.Background()
+				_, sections, _, _ := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+				secArr := (<-sections).(ibus.IArraySection)
+				for _, ok := secArr.Next(ctx); ok; _, ok = secArr.Next(ctx) {
+					if release {
+						ReleaseElement(secArr)
+					}
+				}
+				if _, ok := <-sections; ok {
+					b.Fatal()
+				}
+			}
+			elapsed := time.Since(start).Seconds()
+			b.ReportMetric(float64(b.N*elements)/elapsed, "elements/s")
+		})
+	}
+}
+
+// the element released by the consumer costs the json encoding only, the not released one is encoded by json.Marshal
+// BenchmarkElementEncoding/json.Marshal      2210196	       539.6 ns/op	      32 B/op	       2 allocs/op
+// BenchmarkElementEncoding/released          2797120	       503.4 ns/op	      16 B/op	       1 allocs/op
+func BenchmarkElementEncoding(b *testing.B) {
+	var value interface{} = testPoint{X: 1, Y: 2}
+
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("released", func(b *testing.B) {
+		b.ReportAllocs()
+		e := elementEncoderPool.Get().(*elementEncoder)
+		for i := 0; i < b.N; i++ {
+			_, buf, err := e.encode(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+			releaseElementBuffer(buf)
+		}
+	})
+}
+
+// BenchmarkArraySectionElements/batched-4           5000	     69492 ns/op	     14390 rps	   16728 B/op	     266 allocs/op
+// BenchmarkArraySectionElements/one_by_one-4        5000	    202425 ns/op	      4940 rps	   29736 B/op	     531 allocs/op
+func BenchmarkArraySectionElements(b *testing.B) {
+	const elements = 100
+	handler := func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("secArr", nil)
+			for i := 0; i < elements; i++ {
+				require.NoError(b, rs.SendElement("", []byte("elem")))
+			}
+			rs.Close(nil)
+		}()
+	}
+
+	for name, bus := range map[string]ibus.IBus{
+		"one by one": Provide(handler),
+		"batched":    Provide(handler, WithElementBatching(ElementBatching{MaxElements: 32})),
+	} {
+		b.Run(name, func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				ctx := context.Background()
+				_, sections, _, _ := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+				secArr := (<-sections).(ibus.IArraySection)
+				for _, ok := secArr.Next(ctx); ok; _, ok = secArr.Next(ctx) {
+				}
+				if _, ok := <-sections; ok {
+					b.Fatal()
+				}
+			}
+			elapsed := time.Since(start).Seconds()
+			b.ReportMetric(float64(b.N)/elapsed, "rps")
+		})
+	}
+}
+
+// producer is blocked by the consumer on most of sends so the timeout timer is armed for most of elements
+// the timer of the stream is reused and deadlines of streams are fired by the timer shared by the bus,
+// so there is no timer allocation per send
+// BenchmarkManySectionElements/1_streams      76	  14527712 ns/op	    688341 elements/s	  282984 B/op	   20038 allocs/op
+// BenchmarkManySectionElements/10_streams      9	 135722611 ns/op	    736799 elements/s	 2829699 B/op	  200371 allocs/op
+func BenchmarkManySectionElements(b *testing.B) {
+	const elements = 10000
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("secArr", nil)
+			for i := 0; i < elements; i++ {
+				require.NoError(b, rs.SendElement("", []byte("elem")))
+			}
+			rs.Close(nil)
+		}()
+	})
+	readAll := func() {
+		ctx := context.Background()
+		_, sections, _, _ := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		secArr := (<-sections).(ibus.IArraySection)
+		for _, ok := secArr.Next(ctx); ok; _, ok = secArr.Next(ctx) {
+		}
+		if _, ok := <-sections; ok {
+			b.Error()
+		}
+	}
+
+	for _, streams := range []int{1, 10} {
+		b.Run(fmt.Sprint(streams, " streams"), func(b *testing.B) {
+			b.ReportAllocs()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				wg := sync.WaitGroup{}
+				for j := 0; j < streams; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						readAll()
+					}()
+				}
+				wg.Wait()
+			}
+			elapsed := time.Since(start).Seconds()
+			b.ReportMetric(float64(b.N*streams*elements)/elapsed, "elements/s")
+		})
+	}
+}
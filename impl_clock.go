@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"sync"
+	"time"
+)
+
+// SystemClock is the real time clock used by the bus by default
+var SystemClock IClock = systemClock{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) ITimer { return systemTimer{time.NewTimer(d)} }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ITimer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.timer.C }
+
+func (t systemTimer) Stop() bool { return t.timer.Stop() }
+
+func (t systemTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+func newManualClock(now time.Time) *manualClock {
+	c := &manualClock{now: now}
+	c.armedChanged = sync.NewCond(&c.Mutex)
+	return c
+}
+
+func (c *manualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *manualClock) NewTimer(d time.Duration) ITimer {
+	t := &manualTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) ITimer {
+	t := &manualTimer{
+		clock: c,
+		f:     f,
+	}
+	t.Reset(d)
+	return t
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	until := c.now.Add(d)
+	for {
+		t := c.nextDue(until)
+		if t == nil {
+			break
+		}
+		c.now = t.deadline
+		c.disarm(t)
+		t.fire(c.now)
+	}
+	c.now = until
+}
+
+func (c *manualClock) BlockUntil(timers int) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.armed) < timers {
+		c.armedChanged.Wait()
+	}
+}
+
+func (c *manualClock) Arms() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.arms
+}
+
+func (c *manualClock) BlockUntilArms(arms int) {
+	c.Lock()
+	defer c.Unlock()
+	for c.arms < arms {
+		c.armedChanged.Wait()
+	}
+}
+
+// the earliest armed timer which deadline is not after until, the first armed one if deadlines are equal
+// must be called under the clock lock
+func (c *manualClock) nextDue(until time.Time) (due *manualTimer) {
+	for _, t := range c.armed {
+		if !t.deadline.After(until) && (due == nil || t.deadline.Before(due.deadline)) {
+			due = t
+		}
+	}
+	return due
+}
+
+// must be called under the clock lock
+func (c *manualClock) arm(t *manualTimer) {
+	c.armed = append(c.armed, t)
+	c.arms++
+	c.armedChanged.Broadcast()
+}
+
+// must be called under the clock lock
+func (c *manualClock) disarm(t *manualTimer) bool {
+	for i, armed := range c.armed {
+		if armed == t {
+			c.armed = append(c.armed[:i], c.armed[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.c }
+
+func (t *manualTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	t.drain()
+	return t.clock.disarm(t)
+}
+
+// timer is fired immediately if d is not positive
+func (t *manualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	t.drain()
+	wasArmed := c.disarm(t)
+	t.deadline = c.now.Add(d)
+	if d <= 0 {
+		t.fire(c.now)
+	} else {
+		c.arm(t)
+	}
+	return wasArmed
+}
+
+// f is called in its own goroutine as by time.AfterFunc since it could wait for the clock, e.g. for the consumer timeout
+func (t *manualTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	t.c <- now
+}
+
+func (t *manualTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
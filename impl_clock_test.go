@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestManualClock_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	require.Equal(start, clock.Now())
+
+	t1 := clock.NewTimer(2 * time.Second)
+	t2 := clock.NewTimer(time.Second)
+	called := make(chan time.Time, 1)
+	clock.AfterFunc(time.Second, func() { called <- clock.Now() })
+	require.Nil(clock.AfterFunc(time.Hour, func() {}).C())
+
+	clock.Advance(time.Second - time.Nanosecond)
+	require.Empty(t1.C())
+	require.Empty(t2.C())
+	require.Empty(called)
+
+	clock.Advance(time.Nanosecond)
+	require.Equal(start.Add(time.Second), <-t2.C())
+	require.Empty(t1.C())
+	require.Equal(start.Add(time.Second), <-called)
+
+	// timers are fired at their deadlines even if the time is moved further
+	clock.Advance(time.Hour)
+	require.Equal(start.Add(2*time.Second), <-t1.C())
+	require.Equal(start.Add(time.Hour+time.Second), clock.Now())
+
+	t.Run("Not positive duration fires immediately", func(t *testing.T) {
+		require.Equal(clock.Now(), <-clock.NewTimer(0).C())
+		require.Equal(clock.Now(), <-clock.NewTimer(-time.Second).C())
+	})
+}
+
+func TestManualClock_StopAndReset(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	timer := clock.NewTimer(time.Second)
+
+	require.True(timer.Stop())
+	require.False(timer.Stop())
+	clock.Advance(time.Hour)
+	require.Empty(timer.C())
+
+	require.False(timer.Reset(time.Second))
+	require.True(timer.Reset(2 * time.Second))
+	clock.Advance(time.Second)
+	require.Empty(timer.C())
+
+	// the stale fire is dropped
+	clock.Advance(time.Second)
+	require.Len(timer.C(), 1)
+	require.False(timer.Reset(time.Second))
+	require.Empty(timer.C())
+	clock.Advance(time.Second)
+	require.Len(timer.C(), 1)
+	require.False(timer.Stop())
+	require.Empty(timer.C())
+}
+
+func TestManualClock_BlockUntil(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	armed := make(chan struct{})
+	go func() {
+		defer close(armed)
+		clock.BlockUntil(2)
+	}()
+	clock.NewTimer(time.Second)
+	require.Never(func() bool { return isClosed(armed) }, 50*time.Millisecond, time.Millisecond)
+	clock.NewTimer(time.Second)
+	<-armed
+	clock.BlockUntil(1)
+}
+
+func TestManualClock_BlockUntilArms(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	timer := clock.NewTimer(time.Second)
+	require.Equal(1, clock.Arms())
+
+	armed := make(chan struct{})
+	go func() {
+		defer close(armed)
+		clock.BlockUntilArms(2)
+	}()
+	clock.BlockUntil(1) // the timer is armed already
+	require.Never(func() bool { return isClosed(armed) }, 50*time.Millisecond, time.Millisecond)
+	timer.Reset(time.Second) // re-armed timer is counted again
+	<-armed
+	require.Equal(2, clock.Arms())
+
+	timer.Stop()
+	clock.AfterFunc(time.Second, func() {})
+	require.Equal(3, clock.Arms())
+}
+
+func TestManualClock_Bus(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	metrics := NewMetrics()
+	sendErr := make(chan error, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			clock.Advance(time.Second) // stream duration
+			rs.StartArraySection("arr", nil)
+			sendErr <- rs.SendElement("", 1)
+			rs.Close(nil)
+		}()
+	}, WithClock(clock), WithMetrics(metrics))
+
+	_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, time.Minute)
+	require.NoError(err)
+
+	// the section is not read
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute - time.Nanosecond)
+	require.Never(func() bool { return len(sendErr) > 0 }, 50*time.Millisecond, time.Millisecond)
+	clock.Advance(time.Nanosecond)
+	require.ErrorIs(<-sendErr, ibus.ErrNoConsumer)
+	for range sections {
+	}
+
+	buf := bytes.Buffer{}
+	require.NoError(metrics.WriteText(&buf))
+	require.Contains(buf.String(), `ibusmem_stream_duration_seconds_sum 61`+"\n")
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	ibus "github.com/untillpro/airs-ibus"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// built-in codecs
+var (
+	CodecJSON    ICodec = jsonCodec{}
+	CodecMsgPack ICodec = msgPackCodec{}
+	CodecCBOR    ICodec = cborCodec{}
+)
+
+// CBOR maps are decoded into map[string]interface{} to be compatible with JSON, e.g. for transcoding by CollectSections
+var cborDecMode = func() cbor.DecMode {
+	dm, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		// notest
+		panic(err)
+	}
+	return dm
+}()
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) { return json.Marshal(value) }
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error { return json.Unmarshal(data, value) }
+
+func (msgPackCodec) ContentType() string { return ContentTypeMsgPack }
+
+// json struct tags are respected to get the same field names as CodecJSON does
+func (msgPackCodec) Marshal(value interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag(jsonStructTag)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgPackCodec) Unmarshal(data []byte, value interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag(jsonStructTag)
+	return dec.Decode(value)
+}
+
+func (cborCodec) ContentType() string { return ContentTypeCBOR }
+
+func (cborCodec) Marshal(value interface{}) ([]byte, error) { return cbor.Marshal(value) }
+
+func (cborCodec) Unmarshal(data []byte, value interface{}) error {
+	return cborDecMode.Unmarshal(data, value)
+}
+
+// RequestCodec returns the codec negotiated for the request, so the request handler could encode []byte elements by itself
+// CodecJSON is returned if requestCtx is not provided by the bus
+func RequestCodec(requestCtx context.Context) ICodec {
+	if codec, ok := requestCtx.Value(ctxKeyCodec).(ICodec); ok {
+		return codec
+	}
+	return CodecJSON
+}
+
+// SectionCodec returns the codec which encoded elements of the section
+// CodecJSON is returned for sections not provided by the bus, e.g. by a SenderInterceptor
+func SectionCodec(section ibus.ISection) ICodec {
+	switch typed := section.(type) {
+	case *arraySection:
+		return typed.codec
+	case *mapSection:
+		return typed.codec
+	case *objectSection:
+		return typed.codec
+	}
+	return CodecJSON
+}
+
+// the codec having the highest quality in the Accept request header is chosen, the first one wins on equal qualities
+// the most specific media range is applied to the codec: "application/json" over "application/*" over "*/*"
+// the default codec is used if there is no Accept header or no acceptable codec
+func (b *bus) negotiateCodec(header map[string][]string) ICodec {
+	ranges := acceptedMediaRanges(header)
+	if len(ranges) == 0 {
+		return b.codec
+	}
+	res := b.codec
+	bestQuality := 0.0
+	for _, codec := range b.codecs {
+		if quality := codecQuality(codec.ContentType(), ranges); quality > bestQuality {
+			res, bestQuality = codec, quality
+		}
+	}
+	return res
+}
+
+func acceptedMediaRanges(header map[string][]string) (ranges []acceptedMediaRange) {
+	for name, values := range header {
+		if !strings.EqualFold(name, acceptHeader) {
+			continue
+		}
+		for _, value := range values {
+			for _, part := range strings.Split(value, ",") {
+				if r, ok := parseMediaRange(part); ok {
+					ranges = append(ranges, r)
+				}
+			}
+		}
+	}
+	return ranges
+}
+
+// e.g. "application/json;q=0.9", media ranges having malformed quality are ignored
+func parseMediaRange(s string) (r acceptedMediaRange, ok bool) {
+	params := strings.Split(s, ";")
+	r.mediaRange = strings.ToLower(strings.TrimSpace(params[0]))
+	r.quality = defaultQuality
+	if len(r.mediaRange) == 0 {
+		return r, false
+	}
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), qualityParam) {
+			continue
+		}
+		quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || quality < 0 || quality > 1 {
+			return r, false
+		}
+		r.quality = quality
+	}
+	return r, true
+}
+
+func codecQuality(contentType string, ranges []acceptedMediaRange) float64 {
+	contentType = strings.ToLower(contentType)
+	mainType, _, _ := strings.Cut(contentType, "/")
+	quality, specificity := 0.0, 0
+	for _, r := range ranges {
+		rSpecificity := 0
+		switch r.mediaRange {
+		case contentType:
+			rSpecificity = 3
+		case mainType + "/*":
+			rSpecificity = 2
+		case anyMediaRange:
+			rSpecificity = 1
+		}
+		if rSpecificity > specificity {
+			quality, specificity = r.quality, rSpecificity
+		}
+	}
+	return quality
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestCodecs_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		codec := RequestCodec(requestCtx)
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("points", nil)
+			require.NoError(rs.SendElement("", testPoint{X: 1, Y: 2}))
+			bb, err := codec.Marshal(testPoint{X: 3, Y: 4})
+			require.NoError(err)
+			require.NoError(rs.SendElement("", bb))
+			require.NoError(rs.ObjectSection("obj", nil, map[string]interface{}{"name": "x"}))
+			rs.Close(nil)
+		}()
+	})
+
+	for _, codec := range []ICodec{CodecJSON, CodecMsgPack, CodecCBOR} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			ctx := context.Background()
+			request := ibus.Request{Header: map[string][]string{"accept": {codec.ContentType()}}}
+
+			_, sections, secErr, err := bus.SendRequest2(ctx, request, ibus.DefaultTimeout)
+			require.NoError(err)
+			arr := (<-sections).(ibus.IArraySection)
+			require.Equal(codec, SectionCodec(arr))
+			bb, ok := arr.Next(ctx)
+			require.True(ok)
+			expected, err := codec.Marshal(testPoint{X: 1, Y: 2})
+			require.NoError(err)
+			require.Equal(expected, bb)
+			point := testPoint{}
+			require.NoError(codec.Unmarshal(bb, &point))
+			require.Equal(testPoint{X: 1, Y: 2}, point)
+			points := ArrayOf[testPoint](arr)
+			point, ok = points.Next(ctx)
+			require.True(ok)
+			require.Equal(testPoint{X: 3, Y: 4}, point)
+			obj := (<-sections).(ibus.IObjectSection)
+			value, err := ObjectOf[map[string]string](ctx, obj)
+			require.NoError(err)
+			require.Equal(map[string]string{"name": "x"}, value)
+			for range sections {
+			}
+			require.NoError(*secErr)
+
+			// transcoded to JSON
+			_, sections, secErr, err = bus.SendRequest2(ctx, request, ibus.DefaultTimeout)
+			require.NoError(err)
+			doc, err := CollectSections(ctx, sections, secErr, 0)
+			require.NoError(err)
+			require.JSONEq(`{"sections":[{"type":"points","elements":[{"x":1,"y":2},{"x":3,"y":4}]},{"type":"obj","elements":{"name":"x"}}]}`, string(doc))
+		})
+	}
+}
+
+func TestCodecs_Negotiation(t *testing.T) {
+	b := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {}).(*bus)
+	cases := []struct {
+		name     string
+		accept   []string
+		expected ICodec
+	}{
+		{"no Accept header", nil, CodecJSON},
+		{"exact", []string{"application/cbor"}, CodecCBOR},
+		{"case insensitive", []string{"Application/MsgPack"}, CodecMsgPack},
+		{"any", []string{"*/*"}, CodecJSON},
+		{"unsupported", []string{"text/html"}, CodecJSON},
+		{"quality", []string{"application/json;q=0.5, application/msgpack;q=0.8"}, CodecMsgPack},
+		{"several values", []string{"application/json;q=0.5", "application/cbor"}, CodecCBOR},
+		{"most specific range wins", []string{"application/*", "application/json;q=0.1"}, CodecMsgPack},
+		{"excluded", []string{"application/json;q=0, */*"}, CodecMsgPack},
+		{"malformed quality is ignored", []string{"application/cbor;q=x, application/msgpack;q=0.1"}, CodecMsgPack},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := map[string][]string{}
+			if c.accept != nil {
+				header["Accept"] = c.accept
+			}
+			require.Equal(t, c.expected, b.negotiateCodec(header))
+		})
+	}
+}
+
+func TestCodecs_WithCodecs(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			require.NoError(rs.ObjectSection("", nil, 42))
+			rs.Close(nil)
+		}()
+	}, WithCodecs(CodecCBOR, CodecJSON))
+	ctx := context.Background()
+	for accept, expected := range map[string]ICodec{
+		"":                    CodecCBOR,
+		"application/json":    CodecJSON,
+		"application/msgpack": CodecCBOR, // not negotiable
+	} {
+		_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{Header: map[string][]string{"Accept": {accept}}}, ibus.DefaultTimeout)
+		require.NoError(err)
+		obj := (<-sections).(ibus.IObjectSection)
+		require.Equal(expected, SectionCodec(obj))
+		value, err := ObjectOf[int](ctx, obj)
+		require.NoError(err)
+		require.Equal(42, value)
+	}
+
+	require.Panics(func() { WithCodecs(nil) })
+	require.Panics(func() { WithCodecs(CodecJSON, nil) })
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// CollectSections reads all sections returned by SendRequest2 and builds the JSON document:
+//
+//	{"sections":[{"type":"secObj","path":["meta"],"elements":{"id":1}},{"type":"secArr","elements":[1,2]},{"type":"secMap","elements":{"id1":1}}]}
+//
+// path is omitted if empty, JSON elements are embedded as is, elements encoded by other codecs are transcoded to JSON, see SectionCodec
+// if the stream is closed with an error then "status" and "errorDescription" are added to the document and the error is returned along with the document
+// the status is taken from *BusError, e.g. 504 for ErrStreamDeadlineExceeded, 500 is used for other errors
+// ErrResponseTooLarge is returned if the document exceeds maxSize bytes, 0 means no limit
+// the rest of sections is not read on error so the sender gets ibus.ErrNoConsumer
+func CollectSections(ctx context.Context, sections <-chan ibus.ISection, secError *error, maxSize int) (doc []byte, err error) {
+	c := sectionsCollector{maxSize: maxSize}
+	c.buf.WriteString(`{"sections":[`)
+	if sections != nil {
+		if err = c.collect(ctx, sections); err != nil {
+			return nil, err
+		}
+	}
+	c.buf.WriteByte(']')
+	if secError != nil && *secError != nil {
+		err = *secError
+		fmt.Fprintf(&c.buf, `,"status":%d,"errorDescription":`, errorStatus(err))
+		if e := c.writeJSON(err.Error()); e != nil {
+			return nil, e
+		}
+	}
+	c.buf.WriteByte('}')
+	if e := c.checkSize(); e != nil {
+		return nil, e
+	}
+	return c.buf.Bytes(), err
+}
+
+func errorStatus(err error) int {
+	var busErr *BusError
+	if errors.As(err, &busErr) {
+		return busErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+func (c *sectionsCollector) collect(ctx context.Context, sections <-chan ibus.ISection) error {
+	i := 0
+	for section, err := range Sections(ctx, sections, nil) {
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			c.buf.WriteByte(',')
+		}
+		if err := c.collectSection(ctx, section); err != nil {
+			return err
+		}
+		i++
+	}
+	return ctx.Err()
+}
+
+func (c *sectionsCollector) collectSection(ctx context.Context, section ibus.ISection) (err error) {
+	c.buf.WriteString(`{"type":`)
+	if err = c.writeJSON(section.Type()); err != nil {
+		return err
+	}
+	if dataSection, ok := section.(ibus.IDataSection); ok && len(dataSection.Path()) > 0 {
+		c.buf.WriteString(`,"path":`)
+		if err = c.writeJSON(dataSection.Path()); err != nil {
+			return err
+		}
+	}
+	c.buf.WriteString(`,"elements":`)
+	switch typed := section.(type) {
+	case ibus.IObjectSection:
+		err = c.writeElement(typed, typed.Value(ctx))
+	case ibus.IArraySection:
+		err = c.collectArray(ctx, typed)
+	case ibus.IMapSection:
+		err = c.collectMap(ctx, typed)
+	default:
+		// notest
+		return fmt.Errorf("unexpected section %T", section)
+	}
+	if err != nil {
+		return err
+	}
+	c.buf.WriteByte('}')
+	return c.checkSize()
+}
+
+func (c *sectionsCollector) collectArray(ctx context.Context, section ibus.IArraySection) error {
+	c.buf.WriteByte('[')
+	i := 0
+	for value := range ArrayElements(ctx, section) {
+		if i > 0 {
+			c.buf.WriteByte(',')
+		}
+		if err := c.writeElement(section, value); err != nil {
+			return err
+		}
+		i++
+	}
+	c.buf.WriteByte(']')
+	return nil
+}
+
+func (c *sectionsCollector) collectMap(ctx context.Context, section ibus.IMapSection) error {
+	c.buf.WriteByte('{')
+	i := 0
+	for name, value := range MapEntries(ctx, section) {
+		if i > 0 {
+			c.buf.WriteByte(',')
+		}
+		if err := c.writeJSON(name); err != nil {
+			return err
+		}
+		c.buf.WriteByte(':')
+		if err := c.writeElement(section, value); err != nil {
+			return err
+		}
+		i++
+	}
+	c.buf.WriteByte('}')
+	return nil
+}
+
+// nil element, e.g. the object section is read on ctx done, is written as null
+// the element is released since it is copied to the document
+func (c *sectionsCollector) writeElement(section ibus.ISection, value []byte) error {
+	defer ReleaseElement(section)
+	codec := SectionCodec(section)
+	switch {
+	case value == nil:
+		c.buf.WriteString("null")
+	case codec.ContentType() == ContentTypeJSON:
+		c.buf.Write(value)
+	default:
+		var decoded interface{}
+		if err := codec.Unmarshal(value, &decoded); err != nil {
+			return err
+		}
+		return c.writeJSON(decoded)
+	}
+	return c.checkSize()
+}
+
+func (c *sectionsCollector) writeJSON(value interface{}) error {
+	bb, err := json.Marshal(value)
+	if err != nil {
+		// notest
+		return err
+	}
+	c.buf.Write(bb)
+	return c.checkSize()
+}
+
+func (c *sectionsCollector) checkSize() error {
+	if c.maxSize > 0 && c.buf.Len() > c.maxSize {
+		return ErrResponseTooLarge
+	}
+	return nil
+}
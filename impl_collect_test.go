@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestCollectSections(t *testing.T) {
+	require := require.New(t)
+	testErr := errors.New("test \"error\"")
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			// the client could stop reading sections, so stop on the first error
+			err := rs.ObjectSection("secObj", []string{"meta"}, map[string]int{"id": 1})
+			if err == nil {
+				rs.StartMapSection("secMap", []string{"classifier", "2"})
+				err = errors.Join(rs.SendElement("id1", "elem"), rs.SendElement("i\"d2", []byte(`{"x":1}`)))
+			}
+			if err == nil {
+				rs.StartArraySection("secArr", nil)
+				err = errors.Join(rs.SendElement("", 1), rs.SendElement("", "two"))
+				rs.StartArraySection("empty", nil)
+			}
+			switch request.Resource {
+			case "error":
+				err = testErr
+			case "busError":
+				err = fmt.Errorf("wrapped: %w", toBusError(ErrStreamDeadlineExceeded))
+			}
+			rs.Close(err)
+		}()
+	})
+	expectedSections := `{"sections":[` +
+		`{"type":"secObj","path":["meta"],"elements":{"id":1}},` +
+		`{"type":"secMap","path":["classifier","2"],"elements":{"id1":"elem","i\"d2":{"x":1}}},` +
+		`{"type":"secArr","elements":[1,"two"]}` +
+		`]`
+
+	t.Run("Basic usage", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		doc, err := CollectSections(context.Background(), sections, secErr, 0)
+		require.NoError(err)
+		require.Equal(expectedSections+`}`, string(doc))
+		require.True(json.Valid(doc))
+	})
+
+	t.Run("Should add the stream error", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "error"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		doc, err := CollectSections(context.Background(), sections, secErr, 0)
+		require.ErrorIs(err, testErr)
+		require.Equal(expectedSections+`,"status":500,"errorDescription":"test \"error\""}`, string(doc))
+		require.True(json.Valid(doc))
+	})
+
+	t.Run("Should add the status of the bus error", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "busError"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		doc, err := CollectSections(context.Background(), sections, secErr, 0)
+		require.ErrorIs(err, ErrStreamDeadlineExceeded)
+		require.Equal(expectedSections+`,"status":504,"errorDescription":"wrapped: stream deadline exceeded"}`, string(doc))
+	})
+
+	t.Run("Should limit the size", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		doc, err := CollectSections(context.Background(), sections, secErr, len(expectedSections))
+		require.ErrorIs(err, ErrResponseTooLarge)
+		require.Nil(doc)
+	})
+
+	t.Run("Should return error on ctx done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		cancel()
+		doc, err := CollectSections(ctx, sections, secErr, 0)
+		require.ErrorIs(err, context.Canceled)
+		require.Nil(doc)
+	})
+
+	t.Run("No sections", func(t *testing.T) {
+		doc, err := CollectSections(context.Background(), nil, nil, 0)
+		require.NoError(err)
+		require.Equal(`{"sections":[]}`, string(doc))
+	})
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"container/heap"
+	"time"
+)
+
+func newSendDeadlines(clock IClock) *sendDeadlines {
+	return &sendDeadlines{clock: clock}
+}
+
+func (d *sendDeadlines) newTimer() *streamTimer {
+	return &streamTimer{
+		c:         make(chan time.Time, 1),
+		deadlines: d,
+		index:     -1,
+	}
+}
+
+// fires timers which deadlines are passed, the clock timer is re-armed for the earliest deadline left
+// could be called on the deadline which is already stopped or moved, then nothing is fired
+func (d *sendDeadlines) fire() {
+	d.Lock()
+	defer d.Unlock()
+	now := d.clock.Now()
+	for len(d.queue) > 0 && !d.queue[0].deadline.After(now) {
+		t := heap.Pop(&d.queue).(*streamTimer)
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+	if len(d.queue) > 0 {
+		d.timer.Reset(d.queue[0].deadline.Sub(now))
+	}
+}
+
+// re-arms the timer to fire after d
+func (t *streamTimer) reset(d time.Duration) <-chan time.Time {
+	deadlines := t.deadlines
+	deadlines.Lock()
+	defer deadlines.Unlock()
+	t.disarm()
+	t.deadline = deadlines.clock.Now().Add(d)
+	heap.Push(&deadlines.queue, t)
+	if t.index > 0 {
+		return t.c // the clock timer is armed for the earlier deadline already
+	}
+	if deadlines.timer == nil {
+		deadlines.timer = deadlines.clock.AfterFunc(d, deadlines.fire)
+	} else {
+		deadlines.timer.Reset(d)
+	}
+	return t.c
+}
+
+// the clock timer is stopped once there are no deadlines, the earlier fire is harmless otherwise
+func (t *streamTimer) stop() {
+	deadlines := t.deadlines
+	deadlines.Lock()
+	defer deadlines.Unlock()
+	t.disarm()
+	if len(deadlines.queue) == 0 && deadlines.timer != nil {
+		deadlines.timer.Stop()
+	}
+}
+
+// must be called under the deadlines lock
+// the fire which is not received yet is dropped to not to be received by the next send
+func (t *streamTimer) disarm() {
+	if t.index >= 0 {
+		heap.Remove(&t.deadlines.queue, t.index)
+	}
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+func (q deadlineQueue) Len() int { return len(q) }
+
+func (q deadlineQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+
+func (q deadlineQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *deadlineQueue) Push(x any) {
+	t := x.(*streamTimer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *deadlineQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	t.index = -1
+	return t
+}
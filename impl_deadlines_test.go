@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendDeadlines_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newManualClock(start)
+	deadlines := newSendDeadlines(clock)
+	t1, t2, t3 := deadlines.newTimer(), deadlines.newTimer(), deadlines.newTimer()
+
+	c3 := t3.reset(3 * time.Second)
+	c1 := t1.reset(time.Second)
+	c2 := t2.reset(2 * time.Second)
+	require.Equal(1, armedTimers(clock), "the single timer of the clock is shared by deadlines")
+
+	clock.Advance(time.Second)
+	require.Equal(start.Add(time.Second), <-c1)
+	clock.BlockUntil(1) // re-armed for the next deadline
+	require.Empty(c2)
+
+	clock.Advance(time.Second)
+	require.Equal(start.Add(2*time.Second), <-c2)
+	clock.BlockUntil(1)
+	require.Empty(c3)
+
+	t3.stop()
+	require.Zero(armedTimers(clock), "the timer of the clock is stopped once there are no deadlines")
+	clock.Advance(time.Hour)
+	require.Empty(c3)
+}
+
+func TestSendDeadlines_ResetAndStop(t *testing.T) {
+	require := require.New(t)
+	clock := newManualClock(time.Now())
+	deadlines := newSendDeadlines(clock)
+	timer := deadlines.newTimer()
+	other := deadlines.newTimer()
+	otherC := other.reset(time.Hour)
+
+	t.Run("Stopped timer does not fire", func(t *testing.T) {
+		c := timer.reset(time.Second)
+		timer.stop()
+		clock.Advance(time.Second)
+		require.Never(func() bool { return len(c) > 0 }, 20*time.Millisecond, time.Millisecond)
+	})
+
+	t.Run("Not received fire is dropped on reset", func(t *testing.T) {
+		c := timer.reset(time.Second)
+		clock.Advance(time.Second)
+		require.Eventually(func() bool { return len(c) > 0 }, time.Second, time.Millisecond)
+		require.Empty(timer.reset(time.Minute))
+		timer.stop()
+	})
+
+	t.Run("Reset moves the deadline", func(t *testing.T) {
+		c := timer.reset(time.Minute)
+		now := clock.Now()
+		timer.reset(time.Second) // earlier than the armed clock timer
+		clock.Advance(time.Second)
+		require.Equal(now.Add(time.Second), <-c)
+	})
+
+	clock.BlockUntil(1) // re-armed for the deadline of the other timer
+	other.stop()
+	require.Zero(armedTimers(clock))
+	clock.Advance(time.Hour)
+	require.Empty(otherC)
+}
+
+func armedTimers(clock *manualClock) int {
+	clock.Lock()
+	defer clock.Unlock()
+	return len(clock.armed)
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// ArrayOf returns the array section which decodes each element into T on Next by the codec of the section, see SectionCodec
+// elements are released once decoded, see ReleaseElement
+func ArrayOf[T any](section ibus.IArraySection) *ArraySectionOf[T] {
+	return &ArraySectionOf[T]{section: section}
+}
+
+// MapOf returns the map section which decodes each element into T on Next by the codec of the section, see SectionCodec
+// elements are released once decoded, see ReleaseElement
+func MapOf[T any](section ibus.IMapSection) *MapSectionOf[T] {
+	return &MapSectionOf[T]{section: section}
+}
+
+// ObjectOf reads the object section value and decodes it into T
+// *DecodeError wrapping io.EOF is returned if there is no value, e.g. it is read already
+func ObjectOf[T any](ctx context.Context, section ibus.IObjectSection) (value T, err error) {
+	bb := section.Value(ctx)
+	if bb == nil {
+		if err := ctx.Err(); err != nil {
+			return value, err
+		}
+		return value, &DecodeError{SectionType: section.Type(), Path: section.Path(), Err: io.EOF}
+	}
+	err = SectionCodec(section).Unmarshal(bb, &value)
+	ReleaseElement(section)
+	if err != nil {
+		return value, &DecodeError{SectionType: section.Type(), Path: section.Path(), Err: err}
+	}
+	return value, nil
+}
+
+// ok is false on the section end, on ctx done or if the element could not be decoded, see Err
+func (s *ArraySectionOf[T]) Next(ctx context.Context) (value T, ok bool) {
+	if s.err != nil {
+		return value, false
+	}
+	bb, ok := s.section.Next(ctx)
+	if !ok {
+		return value, false
+	}
+	err := SectionCodec(s.section).Unmarshal(bb, &value)
+	ReleaseElement(s.section)
+	if err != nil {
+		s.err = &DecodeError{SectionType: s.section.Type(), Path: s.section.Path(), Index: s.index, Err: err}
+		return value, false
+	}
+	s.index++
+	return value, true
+}
+
+// All iterates over decoded elements, see Next
+func (s *ArraySectionOf[T]) All(ctx context.Context) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for {
+			value, ok := s.Next(ctx)
+			if !ok || !yield(value) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns *DecodeError if Next failed to decode an element
+func (s *ArraySectionOf[T]) Err() error {
+	return s.err
+}
+
+func (s *ArraySectionOf[T]) Type() string {
+	return s.section.Type()
+}
+
+func (s *ArraySectionOf[T]) Path() []string {
+	return s.section.Path()
+}
+
+// ok is false on the section end, on ctx done or if the element could not be decoded, see Err
+func (s *MapSectionOf[T]) Next(ctx context.Context) (name string, value T, ok bool) {
+	if s.err != nil {
+		return "", value, false
+	}
+	name, bb, ok := s.section.Next(ctx)
+	if !ok {
+		return "", value, false
+	}
+	err := SectionCodec(s.section).Unmarshal(bb, &value)
+	ReleaseElement(s.section)
+	if err != nil {
+		s.err = &DecodeError{SectionType: s.section.Type(), Path: s.section.Path(), Index: s.index, Name: name, Err: err}
+		return "", value, false
+	}
+	s.index++
+	return name, value, true
+}
+
+// All iterates over names and decoded elements, see Next
+func (s *MapSectionOf[T]) All(ctx context.Context) iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		for {
+			name, value, ok := s.Next(ctx)
+			if !ok || !yield(name, value) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns *DecodeError if Next failed to decode an element
+func (s *MapSectionOf[T]) Err() error {
+	return s.err
+}
+
+func (s *MapSectionOf[T]) Type() string {
+	return s.section.Type()
+}
+
+func (s *MapSectionOf[T]) Path() []string {
+	return s.section.Path()
+}
+
+func (e *DecodeError) Error() string {
+	element := fmt.Sprintf("element #%d", e.Index)
+	if len(e.Name) > 0 {
+		element = fmt.Sprintf("element %q", e.Name)
+	}
+	return fmt.Sprintf("section %q path [%s] %s: %s", e.SectionType, strings.Join(e.Path, resourceSeparator), element, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
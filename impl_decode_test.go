@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+type testPoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+func TestTypedDecoding_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("points", nil)
+			require.NoError(rs.SendElement("", testPoint{X: 1, Y: 2}))
+			require.NoError(rs.SendElement("", []byte(`{"x":3,"y":4}`)))
+			rs.StartMapSection("names", nil)
+			require.NoError(rs.SendElement("a", "first"))
+			require.NoError(rs.SendElement("b", "second"))
+			require.NoError(rs.ObjectSection("total", nil, 42))
+			rs.Close(nil)
+		}()
+	})
+
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	points := []testPoint{}
+	names := map[string]string{}
+	total := 0
+	for section, err := range Sections(ctx, sections, secErr) {
+		require.NoError(err)
+		switch typed := section.(type) {
+		case ibus.IArraySection:
+			arr := ArrayOf[testPoint](typed)
+			for point := range arr.All(ctx) {
+				points = append(points, point)
+			}
+			require.NoError(arr.Err())
+		case ibus.IMapSection:
+			m := MapOf[string](typed)
+			for name, value := range m.All(ctx) {
+				names[name] = value
+			}
+			require.NoError(m.Err())
+		case ibus.IObjectSection:
+			total, err = ObjectOf[int](ctx, typed)
+			require.NoError(err)
+		}
+	}
+	require.Equal([]testPoint{{X: 1, Y: 2}, {X: 3, Y: 4}}, points)
+	require.Equal(map[string]string{"a": "first", "b": "second"}, names)
+	require.Equal(42, total)
+}
+
+func TestTypedDecoding_Errors(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			switch request.Resource {
+			case "array":
+				rs.StartArraySection("secArr", []string{"classifier", "4"})
+				require.NoError(rs.SendElement("", 1))
+				require.NoError(rs.SendElement("", "two"))
+			case "map":
+				rs.StartMapSection("secMap", nil)
+				require.NoError(rs.SendElement("id1", 1))
+				require.NoError(rs.SendElement("id2", "two"))
+			case "object":
+				require.NoError(rs.ObjectSection("secObj", []string{"meta"}, "str"))
+			}
+			rs.Close(nil)
+		}()
+	})
+	ctx := context.Background()
+	firstSection := func(resource string) ibus.ISection {
+		_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{Resource: resource}, ibus.DefaultTimeout)
+		require.NoError(err)
+		section := <-sections
+		go func() {
+			for range sections {
+			}
+		}()
+		return section
+	}
+
+	t.Run("Array", func(t *testing.T) {
+		arr := ArrayOf[int](firstSection("array").(ibus.IArraySection))
+		value, ok := arr.Next(ctx)
+		require.True(ok)
+		require.Equal(1, value)
+		_, ok = arr.Next(ctx)
+		require.False(ok)
+
+		var decodeErr *DecodeError
+		require.ErrorAs(arr.Err(), &decodeErr)
+		require.Equal("secArr", decodeErr.SectionType)
+		require.Equal([]string{"classifier", "4"}, decodeErr.Path)
+		require.Equal(1, decodeErr.Index)
+		var typeErr *json.UnmarshalTypeError
+		require.ErrorAs(arr.Err(), &typeErr)
+		require.Equal(`section "secArr" path [classifier/4] element #1: `+typeErr.Error(), arr.Err().Error())
+
+		// stays failed
+		_, ok = arr.Next(ctx)
+		require.False(ok)
+	})
+
+	t.Run("Map", func(t *testing.T) {
+		m := MapOf[int](firstSection("map").(ibus.IMapSection))
+		got := map[string]int{}
+		for name, value := range m.All(ctx) {
+			got[name] = value
+		}
+		require.Equal(map[string]int{"id1": 1}, got)
+
+		var decodeErr *DecodeError
+		require.ErrorAs(m.Err(), &decodeErr)
+		require.Equal("secMap", decodeErr.SectionType)
+		require.Equal("id2", decodeErr.Name)
+		require.Contains(m.Err().Error(), `element "id2"`)
+	})
+
+	t.Run("Object", func(t *testing.T) {
+		obj := firstSection("object").(ibus.IObjectSection)
+		_, err := ObjectOf[int](ctx, obj)
+		var decodeErr *DecodeError
+		require.ErrorAs(err, &decodeErr)
+		require.Equal("secObj", decodeErr.SectionType)
+		require.Equal([]string{"meta"}, decodeErr.Path)
+
+		// the value is read already
+		_, err = ObjectOf[int](ctx, obj)
+		require.ErrorIs(err, io.EOF)
+	})
+}
+
+func TestTypedDecoding_CtxDone(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			_ = rs.SendElement("", 1) // ctx could be done already
+			<-requestCtx.Done()
+			rs.Close(nil)
+		}()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	arr := ArrayOf[int]((<-sections).(ibus.IArraySection))
+	_, ok := arr.Next(ctx)
+	require.True(ok)
+	cancel()
+	_, ok = arr.Next(ctx)
+	require.False(ok)
+	require.NoError(arr.Err(), "ctx done is not a decode error")
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+var elementEncoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &elementEncoder{}
+		e.enc = json.NewEncoder(e)
+		return e
+	},
+}
+
+var elementBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := &elementBuffer{}
+		buf.value = buf.inline[:0]
+		return buf
+	},
+}
+
+// ReleaseElement returns the buffer of the element last read from the section by Next or Value to the pool
+// the element value must not be used after the release
+// the release is optional, the stream encodes elements into pooled buffers once the consumer releases the first element
+// elements are encoded by json.Marshal until then, so the consumer which does not release elements gets no benefit and no overhead
+// must be called by the goroutine which reads the section
+func ReleaseElement(section ibus.ISection) {
+	var last **elementBuffer
+	var released *atomic.Bool
+	switch typed := section.(type) {
+	case *arraySection:
+		last, released = &typed.last, typed.released
+	case *mapSection:
+		last, released = &typed.last, typed.released
+	case *objectSection:
+		last, released = &typed.last, typed.released
+	default:
+		return
+	}
+	if released != nil && !released.Load() {
+		released.Store(true)
+	}
+	if *last != nil {
+		releaseElementBuffer(*last)
+		*last = nil
+	}
+}
+
+// large buffers are not pooled to not to keep memory after occasional large elements
+func releaseElementBuffer(buf *elementBuffer) {
+	if cap(buf.value) > maxPooledElementBufferSize {
+		return
+	}
+	buf.value = buf.value[:0]
+	elementBufferPool.Put(buf)
+}
+
+// elements are encoded by CodecJSON into pooled buffers once the consumer releases elements, by ICodec.Marshal otherwise
+func (s *resultSenderClosable) encode(el interface{}) (bb []byte, buf *elementBuffer, err error) {
+	if s.codec != CodecJSON || !s.released.Load() {
+		bb, err = s.codec.Marshal(el)
+		return bb, nil, err
+	}
+	if s.encoder == nil {
+		s.encoder = elementEncoderPool.Get().(*elementEncoder)
+	}
+	return s.encoder.encode(el)
+}
+
+func (s *resultSenderClosable) releaseEncoder() {
+	if s.encoder != nil {
+		elementEncoderPool.Put(s.encoder)
+		s.encoder = nil
+	}
+}
+
+// the trailing newline written by json.Encoder is trimmed to get the same value as json.Marshal returns
+func (e *elementEncoder) encode(value interface{}) (bb []byte, buf *elementBuffer, err error) {
+	e.buf = elementBufferPool.Get().(*elementBuffer)
+	err = e.enc.Encode(value)
+	buf, e.buf = e.buf, nil
+	if err != nil {
+		releaseElementBuffer(buf)
+		return nil, nil, err
+	}
+	if n := len(buf.value); n > 0 && buf.value[n-1] == '\n' {
+		buf.value = buf.value[:n-1]
+	}
+	return buf.value, buf, nil
+}
+
+// json.Encoder writes the encoded value at once on success only
+func (e *elementEncoder) Write(p []byte) (int, error) {
+	e.buf.value = append(e.buf.value, p...)
+	return len(p), nil
+}
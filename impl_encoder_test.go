@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestElementEncoder(t *testing.T) {
+	require := require.New(t)
+	e := elementEncoderPool.Get().(*elementEncoder)
+	defer elementEncoderPool.Put(e)
+
+	t.Run("Should encode as json.Marshal does", func(t *testing.T) {
+		for _, value := range []interface{}{
+			42,
+			"<html> & \"quotes\"",
+			testPoint{X: 1, Y: 2},
+			map[string]interface{}{"b": []int{1, 2}, "a": nil},
+			strings.Repeat("x", elementBufferInlineSize*2),
+		} {
+			expected, err := json.Marshal(value)
+			require.NoError(err)
+
+			bb, buf, err := e.encode(value)
+			require.NoError(err)
+			require.Equal(string(expected), string(bb))
+			require.Equal(bb, buf.value)
+			releaseElementBuffer(buf)
+		}
+	})
+
+	t.Run("Should return the encoding error", func(t *testing.T) {
+		_, _, err := e.encode(make(chan int))
+		var typeErr *json.UnsupportedTypeError
+		require.ErrorAs(err, &typeErr)
+
+		// the encoder is usable after the error
+		bb, _, err := e.encode(1)
+		require.NoError(err)
+		require.Equal("1", string(bb))
+	})
+}
+
+func TestReleaseElement(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			require.NoError(rs.SendElement("", "first"))
+			require.NoError(rs.SendElement("", []byte("raw")))
+			require.NoError(rs.SendElement("", "third"))
+			rs.StartMapSection("map", nil)
+			require.NoError(rs.SendElement("id", 1))
+			require.NoError(rs.ObjectSection("obj", nil, 2))
+			rs.Close(nil)
+		}()
+	})
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	// elements are not pooled until the consumer releases the first one
+	arr := (<-sections).(ibus.IArraySection)
+	value, ok := arr.Next(ctx)
+	require.True(ok)
+	require.Equal(`"first"`, string(value))
+	require.Nil(arr.(*arraySection).last)
+	ReleaseElement(arr)
+	ReleaseElement(arr) // repeatable
+
+	// []byte is sent as is and not pooled
+	value, ok = arr.Next(ctx)
+	require.True(ok)
+	require.Equal("raw", string(value))
+	require.Nil(arr.(*arraySection).last)
+	ReleaseElement(arr)
+
+	// not released elements are kept
+	value, ok = arr.Next(ctx)
+	require.True(ok)
+	require.NotNil(arr.(*arraySection).last)
+	_, ok = arr.Next(ctx)
+	require.False(ok)
+	require.Equal(`"third"`, string(value))
+
+	m := (<-sections).(ibus.IMapSection)
+	name, value, ok := m.Next(ctx)
+	require.True(ok)
+	require.Equal("id", name)
+	require.Equal("1", string(value))
+	require.NotNil(m.(*mapSection).last)
+	ReleaseElement(m)
+	require.Nil(m.(*mapSection).last)
+
+	obj := (<-sections).(ibus.IObjectSection)
+	require.Equal("2", string(obj.Value(ctx)))
+	require.NotNil(obj.(*objectSection).last)
+	ReleaseElement(obj)
+	require.Nil(obj.(*objectSection).last)
+
+	_, ok = <-sections
+	require.False(ok)
+	require.NoError(*secErr)
+
+	// sections not provided by the bus are ignored
+	require.NotPanics(func() { ReleaseElement(nil) })
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func (e *BusError) Error() string {
+	return e.Message
+}
+
+func (e *BusError) Unwrap() error {
+	return e.cause
+}
+
+func (e *BusError) Is(target error) bool {
+	t, ok := target.(*BusError)
+	return ok && len(t.Code) > 0 && t.Code == e.Code
+}
+
+// ToResponse returns the response having the error status and the JSON body with status, code, message and details
+func (e *BusError) ToResponse() ibus.Response {
+	body := busErrorBody{
+		Status:  e.Status,
+		Code:    e.Code,
+		Message: e.Message,
+		Details: e.Details,
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		// details could be not marshalable
+		body.Details = nil
+		data, _ = json.Marshal(body)
+	}
+	return ibus.Response{
+		ContentType: ContentTypeJSON,
+		StatusCode:  e.Status,
+		Data:        data,
+	}
+}
+
+// ResponseFromError returns BusError.ToResponse of err
+// err which is neither *BusError nor the error of the bus is returned as the internal error with 500 Internal Server Error status
+func ResponseFromError(err error) ibus.Response {
+	var busErr *BusError
+	if !errors.As(toBusError(err), &busErr) {
+		busErr = NewBusError(http.StatusInternalServerError, ErrorCodeInternal, err.Error(), err)
+	}
+	return busErr.ToResponse()
+}
+
+// errors of the bus are wrapped into *BusError, other errors, e.g. ctx.Err(), are returned as is
+func toBusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var busErr *BusError
+	if errors.As(err, &busErr) {
+		return err
+	}
+	for _, known := range busErrors {
+		if errors.Is(err, known.cause) {
+			return NewBusError(known.Status, known.Code, err.Error(), err)
+		}
+	}
+	return err
+}
+
+// the panic is returned as the cause of *BusError to keep the status and the code of the error
+func handlePanic(panicErr *PanicError) error {
+	return NewBusError(http.StatusInternalServerError, ErrorCodeHandlerPanic, panicErr.Error(), panicErr)
+}
+
+func (e *PanicError) Error() string {
+	switch value := e.Value.(type) {
+	case string:
+		return value
+	case error:
+		return value.Error()
+	default:
+		return fmt.Sprintf("%#v", value)
+	}
+}
+
+// the panic value is unwrapped if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
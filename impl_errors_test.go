@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestBusError_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	sendErr := make(chan error, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		switch request.Resource {
+		case "panic":
+			panic(errors.New("boom"))
+		case "stream":
+			rs := sender.SendParallelResponse()
+			go func() {
+				sendErr <- rs.ObjectSection("obj", nil, 1)
+				rs.Close(nil)
+			}()
+		}
+	}, WithClock(clock), WithTimeouts(Timeouts{Stream: time.Hour}))
+
+	t.Run("Bus timeout", func(t *testing.T) {
+		go func() {
+			clock.BlockUntil(1)
+			clock.Advance(ibus.DefaultTimeout)
+		}()
+		_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+
+		var busErr *BusError
+		require.ErrorAs(err, &busErr)
+		require.Equal(http.StatusServiceUnavailable, busErr.Status)
+		require.Equal(ErrorCodeBusTimeout, busErr.Code)
+		require.Equal(ibus.ErrBusTimeoutExpired.Error(), err.Error())
+		require.ErrorIs(err, ibus.ErrBusTimeoutExpired)
+		require.ErrorIs(err, &BusError{Code: ErrorCodeBusTimeout})
+		require.NotErrorIs(err, &BusError{Code: ErrorCodeNoConsumer})
+		require.NotErrorIs(err, &BusError{})
+	})
+
+	t.Run("No consumer", func(t *testing.T) {
+		_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "stream"}, time.Minute)
+		require.NoError(err)
+		clock.BlockUntil(2) // the stream deadline and the section send
+		clock.Advance(time.Minute)
+		err = <-sendErr
+		require.ErrorIs(err, ibus.ErrNoConsumer)
+		require.ErrorIs(err, &BusError{Code: ErrorCodeNoConsumer})
+		for range sections {
+		}
+	})
+
+	t.Run("Stream deadline", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "stream"}, 2*time.Hour)
+		require.NoError(err)
+		clock.BlockUntil(2)
+		clock.Advance(time.Hour)
+		for range sections {
+		}
+		var busErr *BusError
+		require.ErrorAs(*secErr, &busErr)
+		require.Equal(http.StatusGatewayTimeout, busErr.Status)
+		require.ErrorIs(*secErr, ErrStreamDeadlineExceeded)
+		require.ErrorIs(<-sendErr, &BusError{Code: ErrorCodeStreamDeadlineExceeded})
+	})
+
+	t.Run("Handler panic", func(t *testing.T) {
+		_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "panic"}, time.Minute)
+		var busErr *BusError
+		require.ErrorAs(err, &busErr)
+		require.Equal(http.StatusInternalServerError, busErr.Status)
+		require.Equal(ErrorCodeHandlerPanic, busErr.Code)
+		require.Equal("boom", busErr.Message)
+	})
+
+	t.Run("Ctx errors are not wrapped", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, _, err := bus.SendRequest2(ctx, ibus.Request{}, time.Minute)
+		require.Equal(context.Canceled, err)
+	})
+}
+
+func TestBusError_ToResponse(t *testing.T) {
+	require := require.New(t)
+	cause := errors.New("no such article")
+	busErr := NewBusError(http.StatusNotFound, "not_found", "article not found", cause)
+	busErr.Details = map[string]interface{}{"id": 42}
+	require.ErrorIs(busErr, cause)
+
+	resp := busErr.ToResponse()
+	require.Equal(http.StatusNotFound, resp.StatusCode)
+	require.Equal(ContentTypeJSON, resp.ContentType)
+	require.JSONEq(`{"status":404,"code":"not_found","message":"article not found","details":{"id":42}}`, string(resp.Data))
+
+	t.Run("Not marshalable details are omitted", func(t *testing.T) {
+		busErr := NewBusError(http.StatusNotFound, "not_found", "article not found", nil)
+		busErr.Details = map[string]interface{}{"func": func() {}}
+		require.JSONEq(`{"status":404,"code":"not_found","message":"article not found"}`, string(busErr.ToResponse().Data))
+	})
+
+	t.Run("ResponseFromError", func(t *testing.T) {
+		for _, testCase := range []struct {
+			err  error
+			body string
+		}{
+			{fmt.Errorf("wrapped: %w", busErr), `{"status":404,"code":"not_found","message":"article not found","details":{"id":42}}`},
+			{ErrBusBusy, `{"status":503,"code":"bus_busy","message":"bus busy"}`},
+			{fmt.Errorf("%w: max 1", ErrLimitExceeded), `{"status":413,"code":"limit_exceeded","message":"limit exceeded: max 1"}`},
+			{cause, `{"status":500,"code":"internal","message":"no such article"}`},
+		} {
+			require.JSONEq(testCase.body, string(ResponseFromError(testCase.err).Data), testCase.err.Error())
+		}
+	})
+}
+
+func TestPanicError(t *testing.T) {
+	require := require.New(t)
+	testErr := errors.New("boom")
+	hooked := make(chan *PanicError, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		switch request.Resource {
+		case "error":
+			panic(testErr)
+		case "string":
+			panic("boom")
+		default:
+			panic(42)
+		}
+	}, WithLogger(&testLogger{}), WithHooks(Hooks{
+		OnPanic: func(requestCtx context.Context, panicErr *PanicError) {
+			hooked <- panicErr
+		},
+	}))
+
+	for resource, expected := range map[string]struct {
+		value   interface{}
+		message string
+	}{
+		"error":  {testErr, "boom"},
+		"string": {"boom", "boom"},
+		"other":  {42, "42"},
+	} {
+		t.Run(resource, func(t *testing.T) {
+			request := ibus.Request{Resource: resource, WSID: 1}
+			_, _, _, err := bus.SendRequest2(context.Background(), request, ibus.DefaultTimeout)
+
+			var panicErr *PanicError
+			require.ErrorAs(err, &panicErr)
+			require.Equal(expected.value, panicErr.Value)
+			require.Equal(expected.message, panicErr.Error())
+			require.Equal(expected.message, err.Error())
+			require.Equal(request, panicErr.Request)
+			require.Contains(string(panicErr.Stack), "TestPanicError")
+			require.ErrorIs(err, &BusError{Code: ErrorCodeHandlerPanic})
+			require.Equal(resource == "error", errors.Is(err, testErr))
+			require.Same(panicErr, <-hooked)
+		})
+	}
+}
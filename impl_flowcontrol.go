@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import ibus "github.com/untillpro/airs-ibus"
+
+func newFlowWindow(maxBytes int) *flowWindow {
+	return &flowWindow{
+		maxBytes: maxBytes,
+		freed:    make(chan struct{}, 1),
+	}
+}
+
+// the first element is taken even if it is larger than the window to not to stuck
+func (w *flowWindow) tryAcquire(size int) bool {
+	w.Lock()
+	defer w.Unlock()
+	if w.bytes > 0 && w.bytes+size > w.maxBytes {
+		return false
+	}
+	w.bytes += size
+	return true
+}
+
+// nil window means there is no bytes window for the stream
+func (w *flowWindow) release(size int) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	w.bytes -= size
+	w.Unlock()
+	select {
+	case w.freed <- struct{}{}:
+	default:
+	}
+}
+
+// producer waits for the client to read previous elements if the bytes window is full
+// kind and type of the section are provided by the caller since the batch is delivered also by the MaxLatency timer
+func (s *resultSenderClosable) acquireWindow(size int, kind ibus.SectionKind, sectionType string) error {
+	if s.window == nil || s.window.tryAcquire(size) {
+		return nil
+	}
+	s.metrics.ProducerBlocked(kind, sectionType)
+	defer s.stopTimeout()
+	timeout := s.elementTimeout()
+	for {
+		select {
+		case <-s.window.freed:
+			if s.window.tryAcquire(size) {
+				return nil
+			}
+		case <-s.clientCtx.Done():
+			return s.clientCtx.Err()
+		case <-timeout:
+			s.metrics.NoConsumer()
+			return ibus.ErrNoConsumer
+		case <-s.stop:
+			return ErrBusClosed
+		case <-s.deadlineExceeded:
+			return ErrStreamDeadlineExceeded
+		}
+	}
+}
+
+func elementsSize(elements []element) (size int) {
+	for _, e := range elements {
+		size += len(e.value)
+	}
+	return size
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestFlowControl_WindowElements(t *testing.T) {
+	require := require.New(t)
+	metrics := NewMetrics()
+	sent := make(chan int, 10)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			for i := 0; i < 4; i++ {
+				require.NoError(rs.SendElement("", i))
+				sent <- i
+			}
+			require.NoError(rs.ObjectSection("obj", nil, 42))
+			rs.Close(nil)
+		}()
+	}, WithFlowControl(FlowControl{WindowElements: 3}), WithMetrics(metrics))
+
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	// the section and the window of elements are sent without waiting for the client
+	for i := 0; i < 3; i++ {
+		require.Equal(i, <-sent)
+	}
+	require.Never(func() bool { return len(sent) > 0 }, 50*time.Millisecond, time.Millisecond)
+
+	arr := (<-sections).(ibus.IArraySection)
+	got := []string{}
+	for value := range ArrayElements(ctx, arr) {
+		got = append(got, string(value))
+	}
+	require.Equal([]string{"0", "1", "2", "3"}, got)
+	obj := (<-sections).(ibus.IObjectSection)
+	require.Equal("42", string(obj.Value(ctx)))
+	_, ok := <-sections
+	require.False(ok)
+	require.NoError(*secErr)
+
+	buf := bytes.Buffer{}
+	require.NoError(metrics.WriteText(&buf))
+	require.Contains(buf.String(), `ibusmem_producer_blocked_total{kind="array",type="arr"} 1`+"\n")
+	require.NotContains(buf.String(), `ibusmem_producer_blocked_total{kind="object"`)
+}
+
+func TestFlowControl_WindowBytes(t *testing.T) {
+	require := require.New(t)
+	sent := make(chan int, 10)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartMapSection("map", nil)
+			require.NoError(rs.SendElement("a", []byte("1234")))
+			sent <- 1
+			require.NoError(rs.SendElement("b", []byte("1234")))
+			sent <- 2
+			require.NoError(rs.SendElement("c", []byte(strings.Repeat("x", 20))))
+			sent <- 3
+			rs.Close(nil)
+		}()
+	}, WithFlowControl(FlowControl{WindowElements: 10, WindowBytes: 8}))
+
+	ctx := context.Background()
+	_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal(1, <-sent)
+	require.Equal(2, <-sent)
+
+	// the window is full
+	require.Never(func() bool { return len(sent) > 0 }, 50*time.Millisecond, time.Millisecond)
+
+	m := (<-sections).(ibus.IMapSection)
+	name, _, ok := m.Next(ctx)
+	require.True(ok)
+	require.Equal("a", name)
+
+	// the element larger than the window waits until all previous elements are read
+	require.Never(func() bool { return len(sent) > 0 }, 50*time.Millisecond, time.Millisecond)
+	name, _, ok = m.Next(ctx)
+	require.True(ok)
+	require.Equal("b", name)
+	require.Equal(3, <-sent)
+
+	name, value, ok := m.Next(ctx)
+	require.True(ok)
+	require.Equal("c", name)
+	require.Len(value, 20)
+}
+
+func TestFlowControl_NoConsumer(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	provideBus := func(elements int, sendErrs chan error) ibus.IBus {
+		return Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			rs := sender.SendParallelResponse()
+			go func() {
+				defer close(sendErrs)
+				rs.StartArraySection("arr", nil)
+				for i := 0; i < elements; i++ {
+					sendErrs <- rs.SendElement("", i)
+				}
+				rs.Close(nil)
+			}()
+		}, WithClock(clock), WithFlowControl(FlowControl{WindowElements: 2}))
+	}
+
+	t.Run("Should not fail while the client pauses", func(t *testing.T) {
+		sendErrs := make(chan error, 10)
+		bus := provideBus(2, sendErrs)
+		ctx := context.Background()
+		_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{}, 10*time.Millisecond)
+		require.NoError(err)
+		for err := range sendErrs {
+			require.NoError(err)
+		}
+		clock.Advance(time.Minute)
+		arr := (<-sections).(ibus.IArraySection)
+		amount := 0
+		for range ArrayElements(ctx, arr) {
+			amount++
+		}
+		require.Equal(2, amount)
+	})
+
+	t.Run("Should fail if the window is not freed", func(t *testing.T) {
+		sendErrs := make(chan error, 10)
+		bus := provideBus(3, sendErrs)
+		_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, 10*time.Millisecond)
+		require.NoError(err)
+		require.NoError(<-sendErrs)
+		require.NoError(<-sendErrs)
+		clock.BlockUntil(1)
+		clock.Advance(10 * time.Millisecond)
+		require.ErrorIs(<-sendErrs, ibus.ErrNoConsumer)
+		for range sections {
+		}
+	})
+
+	t.Run("Should panic on wrong config", func(t *testing.T) {
+		require.Panics(func() { WithFlowControl(FlowControl{}) })
+		require.Panics(func() { WithFlowControl(FlowControl{WindowElements: 1, WindowBytes: -1}) })
+	})
+}
+
+func TestFlowControl_ElementBatching(t *testing.T) {
+	require := require.New(t)
+	const elements = 10
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			for i := 0; i < elements; i++ {
+				require.NoError(rs.SendElement("", i))
+			}
+			rs.StartMapSection("map", nil)
+			for i := 0; i < elements; i++ {
+				require.NoError(rs.SendElement(strconv.Itoa(i), i))
+			}
+			rs.Close(nil)
+		}()
+	}, WithElementBatching(ElementBatching{MaxElements: 3}), WithFlowControl(FlowControl{WindowElements: 8}))
+
+	// buffered batches are received before the closed elements channel is noticed
+	for run := 0; run < 100; run++ {
+		ctx := context.Background()
+		_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		arr := (<-sections).(ibus.IArraySection)
+		m := (<-sections).(ibus.IMapSection)
+		for _, ok := <-sections; ok; _, ok = <-sections {
+		}
+		arrCount, mapCount := 0, 0
+		for range ArrayElements(ctx, arr) {
+			arrCount++
+		}
+		for range MapEntries(ctx, m) {
+			mapCount++
+		}
+		require.Equal(elements, arrCount)
+		require.Equal(elements, mapCount)
+		require.NoError(*secErr)
+	}
+}
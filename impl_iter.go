@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"iter"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// Sections iterates over sections returned by SendRequest2:
+//
+//	for section, err := range ibusmem.Sections(ctx, sections, secError) {
+//		if err != nil {
+//			// ctx.Err() or *secError
+//		}
+//		...
+//	}
+//
+// all elements of the section must be read before the next iteration, as for the sections channel
+// the last pair is (nil, err) if ctx is done or the stream is closed with an error, ctx.Err() has priority
+func Sections(ctx context.Context, sections <-chan ibus.ISection, secError *error) iter.Seq2[ibus.ISection, error] {
+	return func(yield func(ibus.ISection, error) bool) {
+		for {
+			select {
+			case section, ok := <-sections:
+				if !ok {
+					if err := ctx.Err(); err != nil {
+						yield(nil, err)
+					} else if secError != nil && *secError != nil {
+						yield(nil, *secError)
+					}
+					return
+				}
+				if err := ctx.Err(); err != nil {
+					yield(nil, err)
+					return
+				}
+				if !yield(section, nil) {
+					return
+				}
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			}
+		}
+	}
+}
+
+// ArrayElements iterates over elements of the array section until the section end or ctx done
+// the value could be released by ReleaseElement(section) within the loop body
+func ArrayElements(ctx context.Context, section ibus.IArraySection) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for {
+			value, ok := section.Next(ctx)
+			if !ok || !yield(value) {
+				return
+			}
+		}
+	}
+}
+
+// MapEntries iterates over name-value pairs of the map section until the section end or ctx done
+// the value could be released by ReleaseElement(section) within the loop body
+func MapEntries(ctx context.Context, section ibus.IMapSection) iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		for {
+			name, value, ok := section.Next(ctx)
+			if !ok || !yield(name, value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestIterators_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	testErr := errors.New("test error")
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			require.NoError(rs.SendElement("", 1))
+			require.NoError(rs.SendElement("", 2))
+			rs.StartMapSection("map", nil)
+			require.NoError(rs.SendElement("a", 3))
+			require.NoError(rs.SendElement("b", 4))
+			require.NoError(rs.ObjectSection("obj", nil, 5))
+			rs.Close(testErr)
+		}()
+	})
+
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	got := []string{}
+	var lastErr error
+	for section, err := range Sections(ctx, sections, secErr) {
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch typed := section.(type) {
+		case ibus.IArraySection:
+			for value := range ArrayElements(ctx, typed) {
+				got = append(got, typed.Type()+":"+string(value))
+			}
+		case ibus.IMapSection:
+			for name, value := range MapEntries(ctx, typed) {
+				got = append(got, typed.Type()+":"+name+"="+string(value))
+			}
+		case ibus.IObjectSection:
+			got = append(got, typed.Type()+":"+string(typed.Value(ctx)))
+		}
+	}
+	require.Equal([]string{"arr:1", "arr:2", "map:a=3", "map:b=4", "obj:5"}, got)
+	require.ErrorIs(lastErr, testErr)
+}
+
+func TestIterators_Break(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", nil)
+			require.NoError(rs.SendElement("", 1))
+			require.NoError(rs.SendElement("", 2))
+			rs.StartMapSection("map", nil)
+			require.NoError(rs.SendElement("a", 1))
+			require.NoError(rs.SendElement("b", 2))
+			rs.Close(nil)
+		}()
+	})
+
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	sectionsAmount := 0
+	for section, err := range Sections(ctx, sections, secErr) {
+		require.NoError(err)
+		sectionsAmount++
+		switch typed := section.(type) {
+		case ibus.IArraySection:
+			for value := range ArrayElements(ctx, typed) {
+				require.Equal("1", string(value))
+				break
+			}
+			_, ok := typed.Next(ctx)
+			require.True(ok, "the rest of elements is available after break")
+			_, ok = typed.Next(ctx)
+			require.False(ok)
+		case ibus.IMapSection:
+			for name := range MapEntries(ctx, typed) {
+				require.Equal("a", name)
+				break
+			}
+			name, _, ok := typed.Next(ctx)
+			require.True(ok)
+			require.Equal("b", name)
+		}
+	}
+	require.Equal(2, sectionsAmount)
+}
+
+func TestIterators_CtxDone(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			<-requestCtx.Done()
+			rs.Close(nil)
+		}()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	cancel()
+
+	errs := []error{}
+	for section, err := range Sections(ctx, sections, secErr) {
+		require.Nil(section)
+		errs = append(errs, err)
+	}
+	require.Len(errs, 1)
+	require.ErrorIs(errs[0], context.Canceled)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// returns the sender which closes the stream as abandoned once it is garbage collected
+// must be called under the stream lock before the stream is returned to the request handler
+func (s *resultSenderClosable) track(cfg *LeakDetection) *trackedSender {
+	s.createdAt = debug.Stack()
+	if cfg.IdleTimeout > 0 {
+		s.idleTimeout = cfg.IdleTimeout
+		s.lastActivity = s.clock.Now()
+		s.idleTimer = s.clock.AfterFunc(cfg.IdleTimeout, s.checkIdle)
+	}
+	sender := &trackedSender{resultSenderClosable: s}
+	runtime.SetFinalizer(sender, func(sender *trackedSender) {
+		sender.abandon("garbage collected")
+	})
+	return sender
+}
+
+// the producer blocked by the send holds the stream lock, so the stream is idle since the last send is returned
+func (s *resultSenderClosable) checkIdle() {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	if idle := s.clock.Now().Sub(s.lastActivity); idle < s.idleTimeout {
+		s.idleTimer.Reset(s.idleTimeout - idle)
+		return
+	}
+	s.closeAbandoned(fmt.Sprint("idle for ", s.idleTimeout))
+}
+
+func (s *resultSenderClosable) abandon(reason string) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.closeAbandoned(reason)
+	}
+}
+
+// must be called under the stream lock
+func (s *resultSenderClosable) closeAbandoned(reason string) {
+	s.abandoned = true
+	s.logger.Warning("stream abandoned, ", reason, ", created at:\n", string(s.createdAt))
+	s.close(toBusError(ErrStreamAbandoned))
+}
+
+// must be called under the stream lock once the stream method is returned
+func (s *resultSenderClosable) touch() {
+	if s.idleTimer != nil {
+		s.lastActivity = s.clock.Now()
+	}
+}
+
+// returns the error the stream is closed with by the bus, further sends return it instead of panic on the closed stream
+// must be called under the stream lock
+func (s *resultSenderClosable) closedByBus() error {
+	if s.isExpired() {
+		return ErrStreamDeadlineExceeded
+	}
+	if s.abandoned {
+		return ErrStreamAbandoned
+	}
+	return nil
+}
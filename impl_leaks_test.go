@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestLeakDetection_Idle(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	logger := &testLogger{}
+	send := make(chan string)
+	sendErrs := make(chan error)
+	closed := make(chan error, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			for sectionType := range send {
+				sendErrs <- rs.ObjectSection(sectionType, nil, 1)
+			}
+			// the stream is not closed
+		}()
+	}, WithClock(clock), WithLogger(logger), WithFlowControl(FlowControl{WindowElements: 10}),
+		WithLeakDetection(LeakDetection{IdleTimeout: time.Minute}), WithHooks(Hooks{
+			OnStreamClose: func(requestCtx context.Context, err error) {
+				closed <- err
+			},
+		}))
+
+	_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, time.Hour)
+	require.NoError(err)
+	clock.BlockUntil(1)
+
+	// the idle period is restarted by the send
+	clock.Advance(30 * time.Second)
+	send <- "first"
+	require.NoError(<-sendErrs)
+	clock.Advance(30 * time.Second)
+	clock.BlockUntil(1)
+
+	requireFiresAfter(t, clock, 30*time.Second, closed)
+	require.ErrorIs(<-closed, ErrStreamAbandoned)
+	require.Equal("first", (<-sections).Type())
+	_, ok := <-sections
+	require.False(ok)
+	require.ErrorIs(*secErr, ErrStreamAbandoned)
+	require.ErrorIs(*secErr, &BusError{Code: ErrorCodeStreamAbandoned})
+
+	send <- "second"
+	require.ErrorIs(<-sendErrs, ErrStreamAbandoned)
+	close(send)
+
+	logger.Lock()
+	defer logger.Unlock()
+	require.Len(logger.warnings, 1)
+	require.True(strings.HasPrefix(logger.warnings[0], "stream abandoned, idle for 1m0s, created at:"))
+	require.Contains(logger.warnings[0], "TestLeakDetection_Idle")
+
+	t.Run("Should panic on wrong config", func(t *testing.T) {
+		require.Panics(func() { WithLeakDetection(LeakDetection{IdleTimeout: -1}) })
+	})
+}
+
+func TestLeakDetection_GarbageCollected(t *testing.T) {
+	require := require.New(t)
+	logger := &testLogger{}
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "closed" {
+			Go(sender.SendParallelResponse(), func(rs ibus.IResultSender) error {
+				return rs.ObjectSection("obj", nil, 1)
+			})
+			return
+		}
+		sender.SendParallelResponse() // the stream is not closed
+	}, WithLogger(logger), WithLeakDetection(LeakDetection{}))
+
+	ctx := context.Background()
+	_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		runtime.GC()
+		return isClosedSections(sections)
+	}, time.Second, 10*time.Millisecond)
+	require.ErrorIs(*secErr, ErrStreamAbandoned)
+
+	logger.Lock()
+	require.Len(logger.warnings, 1)
+	require.True(strings.HasPrefix(logger.warnings[0], "stream abandoned, garbage collected, created at:"))
+	logger.Unlock()
+
+	t.Run("Closed stream is not abandoned", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{Resource: "closed"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("1", string((<-sections).(ibus.IObjectSection).Value(ctx)))
+		for range sections {
+		}
+		runtime.GC()
+		runtime.GC()
+		require.NoError(*secErr)
+		logger.Lock()
+		defer logger.Unlock()
+		require.Len(logger.warnings, 1)
+	})
+}
+
+func isClosedSections(sections <-chan ibus.ISection) bool {
+	select {
+	case _, ok := <-sections:
+		return !ok
+	default:
+		return false
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+func (b *bus) Shutdown(ctx context.Context) error {
+	b.lifecycle.Lock()
+	b.startClosing()
+	b.lifecycle.Unlock()
+	select {
+	case <-b.lifecycle.drained:
+		b.stopWorkers()
+		return nil
+	case <-ctx.Done():
+		b.Close()
+		return ctx.Err()
+	}
+}
+
+func (b *bus) Close() error {
+	b.lifecycle.Lock()
+	b.startClosing()
+	if !b.lifecycle.stopped {
+		b.lifecycle.stopped = true
+		close(b.lifecycle.stop)
+		for scope := range b.lifecycle.scopes {
+			scope.cancel(toBusError(ErrBusClosed))
+		}
+	}
+	b.lifecycle.Unlock()
+	b.stopWorkers()
+	return nil
+}
+
+// must be called under lifecycle lock
+func (b *bus) startClosing() {
+	if b.lifecycle.closing {
+		return
+	}
+	b.lifecycle.closing = true
+	if len(b.lifecycle.scopes) == 0 {
+		close(b.lifecycle.drained)
+	}
+}
+
+// queued requests are handled anyway: either drained or skipped because of the cancelled requestCtx
+func (b *bus) stopWorkers() {
+	if b.workerPool != nil {
+		b.workerPool.stop()
+	}
+}
+
+// returns requestCtx derived from clientCtx which is cancelled on the bus close
+// the scope is referenced by SendRequest2 and by the request handler
+func (b *bus) enter(clientCtx context.Context) (scope *requestScope, requestCtx context.Context, err error) {
+	scope = &requestScope{bus: b}
+	scope.refs.Store(2)
+	requestCtx, scope.cancel = newRequestContext(clientCtx)
+	b.lifecycle.Lock()
+	defer b.lifecycle.Unlock()
+	if b.lifecycle.closing {
+		scope.cancel(ErrBusClosed)
+		return nil, nil, ErrBusClosed
+	}
+	b.lifecycle.scopes[scope] = struct{}{}
+	return scope, requestCtx, nil
+}
+
+// requestCtx is not derived from clientCtx directly to be cancelled with ErrClientDisconnected as the cause
+// the deadline of clientCtx is kept so requestCtx.Err() is context.DeadlineExceeded once it passes
+func newRequestContext(clientCtx context.Context) (requestCtx context.Context, cancel context.CancelCauseFunc) {
+	requestCtx = context.WithoutCancel(clientCtx)
+	cancelDeadline := func() {}
+	deadline, hasDeadline := clientCtx.Deadline()
+	if hasDeadline {
+		requestCtx, cancelDeadline = context.WithDeadlineCause(requestCtx, deadline,
+			fmt.Errorf("%w: %w", ErrClientDisconnected, context.DeadlineExceeded))
+	}
+	requestCtx, cancelCtx := context.WithCancelCause(requestCtx)
+	stop := context.AfterFunc(clientCtx, func() {
+		if hasDeadline && errors.Is(clientCtx.Err(), context.DeadlineExceeded) {
+			// requestCtx expires by its own deadline
+			return
+		}
+		cancelCtx(fmt.Errorf("%w: %w", ErrClientDisconnected, context.Cause(clientCtx)))
+	})
+	return requestCtx, func(cause error) {
+		stop()
+		cancelCtx(cause)
+		cancelDeadline()
+	}
+}
+
+// returns false if the request is finished already, e.g. SendRequest2 is returned by timeout and the handler is returned
+func (s *requestScope) retain() bool {
+	for {
+		refs := s.refs.Load()
+		if refs == 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// requestCtx is cancelled once the last reference is released
+func (s *requestScope) release() {
+	if s.refs.Add(-1) > 0 {
+		return
+	}
+	s.cancel(nil)
+	b := s.bus
+	b.lifecycle.Lock()
+	defer b.lifecycle.Unlock()
+	delete(b.lifecycle.scopes, s)
+	if b.lifecycle.closing && len(b.lifecycle.scopes) == 0 {
+		close(b.lifecycle.drained)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestShutdown_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		sender.SendResponse(ibus.Response{Data: []byte("ok")})
+	})
+	resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal("ok", string(resp.Data))
+
+	require.NoError(bus.Shutdown(context.Background()))
+
+	resp, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.ErrorIs(err, ErrBusClosed)
+	require.Empty(resp)
+	require.Nil(sections)
+	require.Nil(secErr)
+
+	// repeatable
+	require.NoError(bus.Shutdown(context.Background()))
+	require.NoError(bus.Close())
+}
+
+func TestShutdown_ShouldWaitForInFlightRequests(t *testing.T) {
+	require := require.New(t)
+	releaseHandler := make(chan struct{})
+	closeStream := make(chan struct{})
+	handlerStarted := make(chan struct{})
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			<-closeStream
+			rs.Close(nil)
+		}()
+		close(handlerStarted)
+		<-releaseHandler
+	}, WithWorkerPool(1, 1, nil))
+
+	var sections <-chan ibus.ISection
+	requestDone := make(chan struct{})
+	go func() {
+		defer close(requestDone)
+		var err error
+		_, sections, _, err = bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+	}()
+	<-handlerStarted
+	<-requestDone
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- bus.Shutdown(context.Background())
+	}()
+
+	// new requests are rejected while shutting down
+	require.Eventually(func() bool {
+		_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		return errors.Is(err, ErrBusClosed)
+	}, ibus.DefaultTimeout, time.Millisecond)
+
+	// the handler is not returned yet
+	require.Never(func() bool { return len(shutdownDone) > 0 }, 50*time.Millisecond, time.Millisecond)
+	close(releaseHandler)
+
+	// the stream is not closed yet
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown must wait for the stream close")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(closeStream)
+	for range sections {
+	}
+	require.NoError(<-shutdownDone)
+}
+
+func TestShutdown_ShouldCancelOnCtxDone(t *testing.T) {
+	require := require.New(t)
+	sendErr := make(chan error, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			<-requestCtx.Done()
+			sendErr <- rs.ObjectSection("", nil, 42)
+			rs.Close(nil)
+		}()
+	})
+	_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(bus.Shutdown(ctx), context.DeadlineExceeded)
+
+	// nobody reads sections but ErrBusClosed is returned instead of ErrNoConsumer after the timeout
+	require.ErrorIs(<-sendErr, ErrBusClosed)
+	for range sections {
+	}
+	require.NoError(*secErr)
+}
+
+func TestClose(t *testing.T) {
+	require := require.New(t)
+	handlerStarted := make(chan struct{})
+	handlerCtxDone := make(chan struct{})
+	b := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "blocker" {
+			close(handlerStarted)
+			<-requestCtx.Done()
+			close(handlerCtxDone)
+		}
+	}, WithWorkerPool(1, 10, nil))
+
+	blockerDone := make(chan struct{})
+	go func() {
+		defer close(blockerDone)
+		_, _, _, err := b.SendRequest2(context.Background(), ibus.Request{Resource: "blocker"}, ibus.DefaultTimeout)
+		require.ErrorIs(err, ErrBusClosed)
+	}()
+	<-handlerStarted
+
+	// the request is queued behind the blocker
+	queuedDone := make(chan struct{})
+	go func() {
+		defer close(queuedDone)
+		_, _, _, err := b.SendRequest2(context.Background(), ibus.Request{Resource: "queued"}, ibus.DefaultTimeout)
+		require.ErrorIs(err, ErrBusClosed)
+	}()
+	pool := b.(*bus).workerPool
+	require.Eventually(func() bool {
+		pool.Lock()
+		defer pool.Unlock()
+		return len(pool.partitions[0].tasks) == 1
+	}, ibus.DefaultTimeout, time.Millisecond)
+
+	require.NoError(b.Close())
+	<-handlerCtxDone
+	<-blockerDone
+	<-queuedDone
+
+	// in-flight requests are finished eventually
+	require.NoError(b.Shutdown(context.Background()))
+}
+
+func TestRequestContext(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	handlerStarted := make(chan struct{}, 1)
+	causes := make(chan error, 1)
+	b := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		handlerStarted <- struct{}{}
+		<-requestCtx.Done()
+		causes <- context.Cause(requestCtx)
+	}, WithClock(clock))
+
+	sendRequest := func(ctx context.Context) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, _, _, err := b.SendRequest2(ctx, ibus.Request{}, time.Minute)
+			errs <- err
+		}()
+		<-handlerStarted
+		return errs
+	}
+
+	t.Run("Client disconnected", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := sendRequest(ctx)
+		cancel()
+		cause := <-causes
+		require.ErrorIs(cause, ErrClientDisconnected)
+		require.ErrorIs(cause, context.Canceled)
+		require.Equal("client disconnected: context canceled", cause.Error())
+		require.ErrorIs(<-errs, context.Canceled)
+	})
+
+	t.Run("Response timeout", func(t *testing.T) {
+		errs := sendRequest(context.Background())
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		require.ErrorIs(<-causes, ibus.ErrBusTimeoutExpired)
+		require.ErrorIs(<-errs, ibus.ErrBusTimeoutExpired)
+	})
+
+	t.Run("Client deadline is kept", func(t *testing.T) {
+		deadline := time.Now().Add(time.Hour)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		requestCtx, cancelRequest := newRequestContext(ctx)
+		actual, ok := requestCtx.Deadline()
+		require.True(ok)
+		require.Equal(deadline, actual)
+		cancelRequest(nil)
+		require.ErrorIs(requestCtx.Err(), context.Canceled)
+		require.NoError(ctx.Err())
+	})
+
+	t.Run("Client deadline exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		requestCtx, cancelRequest := newRequestContext(ctx)
+		defer cancelRequest(nil)
+		<-requestCtx.Done()
+		require.Equal(context.DeadlineExceeded, requestCtx.Err())
+		cause := context.Cause(requestCtx)
+		require.ErrorIs(cause, ErrClientDisconnected)
+		require.ErrorIs(cause, context.DeadlineExceeded)
+		require.Equal("client disconnected: context deadline exceeded", cause.Error())
+	})
+
+	t.Run("Bus closed", func(t *testing.T) {
+		errs := sendRequest(context.Background())
+		require.NoError(b.Close())
+		cause := <-causes
+		require.ErrorIs(cause, ErrBusClosed)
+		require.ErrorIs(cause, &BusError{Code: ErrorCodeBusClosed})
+		require.ErrorIs(<-errs, ErrBusClosed)
+	})
+}
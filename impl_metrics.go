@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func (nopMetrics) Request()                                                  {}
+func (nopMetrics) Response()                                                 {}
+func (nopMetrics) ParallelResponse()                                         {}
+func (nopMetrics) Panic()                                                    {}
+func (nopMetrics) BusTimeout()                                               {}
+func (nopMetrics) NoConsumer()                                               {}
+func (nopMetrics) Section(kind ibus.SectionKind, sectionType string)         {}
+func (nopMetrics) Element(kind ibus.SectionKind, sectionType string)         {}
+func (nopMetrics) ProducerBlocked(kind ibus.SectionKind, sectionType string) {}
+func (nopMetrics) RequestDuration(d time.Duration)                           {}
+func (nopMetrics) StreamDuration(d time.Duration)                            {}
+
+func (m *metrics) Request() {
+	m.requests.Add(1)
+}
+
+func (m *metrics) Response() {
+	m.responses.Add(1)
+}
+
+func (m *metrics) ParallelResponse() {
+	m.parallelResponses.Add(1)
+}
+
+func (m *metrics) Panic() {
+	m.panics.Add(1)
+}
+
+func (m *metrics) BusTimeout() {
+	m.busTimeouts.Add(1)
+}
+
+func (m *metrics) NoConsumer() {
+	m.noConsumer.Add(1)
+}
+
+func (m *metrics) Section(kind ibus.SectionKind, sectionType string) {
+	incSectionCounter(&m.sections, kind, sectionType)
+}
+
+func (m *metrics) Element(kind ibus.SectionKind, sectionType string) {
+	incSectionCounter(&m.elements, kind, sectionType)
+}
+
+func (m *metrics) ProducerBlocked(kind ibus.SectionKind, sectionType string) {
+	incSectionCounter(&m.producerBlocked, kind, sectionType)
+}
+
+func (m *metrics) RequestDuration(d time.Duration) {
+	m.requestDuration.observe(d.Seconds())
+}
+
+func (m *metrics) StreamDuration(d time.Duration) {
+	m.streamDuration.observe(d.Seconds())
+}
+
+func (m *metrics) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeCounter(bw, "requests_total", "SendRequest2 calls", m.requests.Load())
+	writeCounter(bw, "responses_total", "Single responses sent by request handlers", m.responses.Load())
+	writeCounter(bw, "parallel_responses_total", "Sectioned responses started by request handlers", m.parallelResponses.Load())
+	writeCounter(bw, "panics_total", "Request handler and producer panics recovered by the bus", m.panics.Load())
+	writeCounter(bw, "bus_timeouts_total", "SendRequest2 calls failed with bus timeout expired", m.busTimeouts.Load())
+	writeCounter(bw, "no_consumer_total", "Section or element sends failed with no consumer for the stream", m.noConsumer.Load())
+	writeSectionCounters(bw, "sections_total", "Sections sent to clients", &m.sections)
+	writeSectionCounters(bw, "elements_total", "Section elements sent to clients", &m.elements)
+	writeSectionCounters(bw, "producer_blocked_total", "Section or element sends waited for the client to read", &m.producerBlocked)
+	m.requestDuration.write(bw, "request_duration_seconds", "SendRequest2 call duration")
+	m.streamDuration.write(bw, "stream_duration_seconds", "Duration of sectioned responses from SendParallelResponse to Close")
+	return bw.Flush()
+}
+
+func incSectionCounter(counters *sync.Map, kind ibus.SectionKind, sectionType string) {
+	key := sectionKey{kind: kind, sectionType: sectionType}
+	counter, ok := counters.Load(key)
+	if !ok {
+		counter, _ = counters.LoadOrStore(key, &atomic.Uint64{})
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.Lock()
+	h.counts[i]++
+	h.sum += value
+	h.count++
+	h.Unlock()
+}
+
+func (h *histogram) write(w io.Writer, name string, help string) {
+	h.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.Unlock()
+
+	writeHeader(w, name, help, "histogram")
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s%s_bucket{le=\"%s\"} %d\n", metricsPrefix, name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s%s_bucket{le=\"+Inf\"} %d\n", metricsPrefix, name, count)
+	fmt.Fprintf(w, "%s%s_sum %s\n", metricsPrefix, name, formatFloat(sum))
+	fmt.Fprintf(w, "%s%s_count %d\n", metricsPrefix, name, count)
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsPrefix, name, metricType)
+}
+
+func writeCounter(w io.Writer, name string, help string, value uint64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s%s %d\n", metricsPrefix, name, value)
+}
+
+// series are sorted by labels to make the output stable
+func writeSectionCounters(w io.Writer, name string, help string, counters *sync.Map) {
+	type series struct {
+		labels string
+		value  uint64
+	}
+	all := []series{}
+	counters.Range(func(key, value any) bool {
+		k := key.(sectionKey)
+		all = append(all, series{
+			labels: fmt.Sprintf(`kind="%s",type="%s"`, sectionKindLabels[k.kind], escapeLabelValue(k.sectionType)),
+			value:  value.(*atomic.Uint64).Load(),
+		})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+	writeHeader(w, name, help, "counter")
+	for _, s := range all {
+		fmt.Fprintf(w, "%s%s{%s} %d\n", metricsPrefix, name, s.labels, s.value)
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
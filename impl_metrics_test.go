@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestMetrics_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	m := NewMetrics()
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		switch request.Resource {
+		case "single":
+			sender.SendResponse(ibus.Response{})
+		case "sectioned":
+			rs := sender.SendParallelResponse()
+			go func() {
+				require.NoError(rs.ObjectSection("obj", nil, 1))
+				rs.StartArraySection("arr", nil)
+				require.NoError(rs.SendElement("", 1))
+				require.NoError(rs.SendElement("", 2))
+				rs.StartMapSection("m\"ap", nil)
+				require.NoError(rs.SendElement("a", 1))
+				rs.Close(nil)
+			}()
+		case "panic":
+			panic("boom")
+		}
+	}, WithMetrics(m))
+
+	_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "single"}, ibus.DefaultTimeout)
+	require.NoError(err)
+	_, _, _, err = bus.SendRequest2(context.Background(), ibus.Request{Resource: "panic"}, ibus.DefaultTimeout)
+	require.Error(err)
+	_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "sectioned"}, ibus.DefaultTimeout)
+	require.NoError(err)
+	readAllSections(sections)
+	require.NoError(*secErr)
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(m.WriteText(buf))
+	text := buf.String()
+	for _, expected := range []string{
+		"# TYPE ibusmem_requests_total counter\nibusmem_requests_total 3\n",
+		"ibusmem_responses_total 1\n",
+		"ibusmem_parallel_responses_total 1\n",
+		"ibusmem_panics_total 1\n",
+		"ibusmem_bus_timeouts_total 0\n",
+		"ibusmem_no_consumer_total 0\n",
+		`ibusmem_sections_total{kind="array",type="arr"} 1` + "\n" +
+			`ibusmem_sections_total{kind="map",type="m\"ap"} 1` + "\n" +
+			`ibusmem_sections_total{kind="object",type="obj"} 1` + "\n",
+		`ibusmem_elements_total{kind="array",type="arr"} 2` + "\n" +
+			`ibusmem_elements_total{kind="map",type="m\"ap"} 1` + "\n" +
+			`ibusmem_elements_total{kind="object",type="obj"} 1` + "\n",
+		"# TYPE ibusmem_request_duration_seconds histogram\n",
+		"ibusmem_request_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+		"ibusmem_request_duration_seconds_count 3\n",
+		"ibusmem_stream_duration_seconds_count 1\n",
+	} {
+		require.Contains(text, expected)
+	}
+}
+
+func TestMetrics_Timeouts(t *testing.T) {
+	require := require.New(t)
+	m := NewMetrics()
+	clock := NewManualClock(time.Now())
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		// do not send response to trigger the timeout case
+	}, WithClock(clock), WithMetrics(m))
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(ibus.DefaultTimeout)
+	}()
+	_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.ErrorIs(err, ibus.ErrBusTimeoutExpired)
+
+	bus = Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("", nil)
+			require.NoError(rs.SendElement("", 1))
+			require.ErrorIs(rs.SendElement("", 2), ibus.ErrNoConsumer)
+			rs.Close(nil)
+		}()
+	}, WithClock(clock), WithMetrics(m), WithFlowControl(FlowControl{WindowElements: 1}))
+	_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	clock.BlockUntil(1) // do not read elements
+	clock.Advance(ibus.DefaultTimeout)
+	for range sections {
+	}
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(m.WriteText(buf))
+	require.Contains(buf.String(), "ibusmem_bus_timeouts_total 1\n")
+	require.Contains(buf.String(), "ibusmem_no_consumer_total 1\n")
+}
+
+func TestMetrics_ProducerPanic(t *testing.T) {
+	require := require.New(t)
+	m := NewMetrics()
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		Go(sender.SendParallelResponse(), func(rs ibus.IResultSender) error {
+			panic("boom")
+		})
+	}, WithMetrics(m))
+	_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	readAllSections(sections)
+	require.Error(*secErr)
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(m.WriteText(buf))
+	require.Contains(buf.String(), "# HELP ibusmem_panics_total Request handler and producer panics recovered by the bus\n")
+	require.Contains(buf.String(), "ibusmem_panics_total 1\n")
+}
+
+func TestHistogram(t *testing.T) {
+	require := require.New(t)
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.1)
+	h.observe(0.5)
+	h.observe(2)
+
+	buf := bytes.NewBuffer(nil)
+	h.write(buf, "test", "test histogram")
+	require.Equal(`# HELP ibusmem_test test histogram
+# TYPE ibusmem_test histogram
+ibusmem_test_bucket{le="0.1"} 2
+ibusmem_test_bucket{le="1"} 3
+ibusmem_test_bucket{le="+Inf"} 4
+ibusmem_test_sum 2.65
+ibusmem_test_count 4
+`, buf.String())
+}
+
+func TestWithMetrics_ShouldPanicOnNil(t *testing.T) {
+	require.Panics(t, func() { WithMetrics(nil) })
+}
+
+func readAllSections(sections <-chan ibus.ISection) {
+	ctx := context.Background()
+	for section := range sections {
+		switch s := section.(type) {
+		case ibus.IObjectSection:
+			s.Value(ctx)
+		case ibus.IArraySection:
+			for _, ok := s.Next(ctx); ok; _, ok = s.Next(ctx) {
+			}
+		case ibus.IMapSection:
+			for _, _, ok := s.Next(ctx); ok; _, _, ok = s.Next(ctx) {
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// Chain wraps handler with middlewares
+// the first middleware is the outermost one: it is the first to get the request and the last to intercept responses,
+// i.e. Chain(h, m1, m2) is m1(m2(h))
+func Chain(handler ibus.RequestHandler, middlewares ...Middleware) ibus.RequestHandler {
+	if handler == nil {
+		panic("request handler must be not nil")
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// InterceptSender returns the middleware which provides the intercepting sender to the next handler
+func InterceptSender(interceptor SenderInterceptor) Middleware {
+	return func(next ibus.RequestHandler) ibus.RequestHandler {
+		return func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			next(requestCtx, &interceptingSender{next: sender, interceptor: interceptor}, request)
+		}
+	}
+}
+
+func (s *interceptingSender) SendResponse(resp ibus.Response) {
+	if s.interceptor.SendResponse == nil {
+		s.next.SendResponse(resp)
+		return
+	}
+	s.interceptor.SendResponse(s.next, resp)
+}
+
+func (s *interceptingSender) SendParallelResponse() ibus.IResultSenderClosable {
+	if s.interceptor.SendParallelResponse == nil {
+		return s.next.SendParallelResponse()
+	}
+	return s.interceptor.SendParallelResponse(s.next)
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestChain_Order(t *testing.T) {
+	require := require.New(t)
+	log := []string{}
+	logMiddleware := func(name string) Middleware {
+		return func(next ibus.RequestHandler) ibus.RequestHandler {
+			return func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+				log = append(log, name+" before")
+				next(requestCtx, sender, request)
+				log = append(log, name+" after")
+			}
+		}
+	}
+	handler := Chain(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		log = append(log, "handler")
+		sender.SendResponse(ibus.Response{})
+	}, logMiddleware("m1"), logMiddleware("m2"), logMiddleware("m3"))
+
+	_, _, _, err := Provide(handler).SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal([]string{"m1 before", "m2 before", "m3 before", "handler", "m3 after", "m2 after", "m1 after"}, log)
+
+	require.Panics(func() { Chain(nil) })
+}
+
+func TestChain_ShortCircuit(t *testing.T) {
+	require := require.New(t)
+	auth := func(next ibus.RequestHandler) ibus.RequestHandler {
+		return func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			if len(request.Header["Authorization"]) == 0 {
+				sender.SendResponse(ibus.CreateResponse(401, "unauthorized"))
+				return
+			}
+			next(requestCtx, sender, request)
+		}
+	}
+	bus := Provide(Chain(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		sender.SendResponse(ibus.CreateResponse(200, "ok"))
+	}, auth))
+
+	resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal(401, resp.StatusCode)
+
+	resp, _, _, err = bus.SendRequest2(context.Background(), ibus.Request{Header: map[string][]string{"Authorization": {"token"}}}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal(200, resp.StatusCode)
+}
+
+type countingResultSender struct {
+	ibus.IResultSenderClosable
+	sections int
+	elements int
+}
+
+func (s *countingResultSender) StartArraySection(sectionType string, path []string) {
+	s.sections++
+	s.IResultSenderClosable.StartArraySection(sectionType, path)
+}
+
+func (s *countingResultSender) SendElement(name string, element interface{}) error {
+	s.elements++
+	return s.IResultSenderClosable.SendElement(name, element)
+}
+
+func TestInterceptSender(t *testing.T) {
+	require := require.New(t)
+	t.Run("Should intercept response", func(t *testing.T) {
+		addHeader := func(prefix string) Middleware {
+			return InterceptSender(SenderInterceptor{
+				SendResponse: func(next ibus.ISender, resp ibus.Response) {
+					resp.Data = append([]byte(prefix), resp.Data...)
+					next.SendResponse(resp)
+				},
+			})
+		}
+		bus := Provide(Chain(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			sender.SendResponse(ibus.Response{Data: []byte("body")})
+		}, addHeader("outer "), addHeader("inner ")))
+
+		resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("outer inner body", string(resp.Data))
+	})
+
+	t.Run("Should intercept sections", func(t *testing.T) {
+		counter := &countingResultSender{}
+		bus := Provide(Chain(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			rs := sender.SendParallelResponse()
+			go func() {
+				rs.StartArraySection("array", nil)
+				require.NoError(rs.SendElement("", 1))
+				require.NoError(rs.SendElement("", 2))
+				rs.Close(nil)
+			}()
+		}, InterceptSender(SenderInterceptor{
+			SendParallelResponse: func(next ibus.ISender) ibus.IResultSenderClosable {
+				counter.IResultSenderClosable = next.SendParallelResponse()
+				return counter
+			},
+		})))
+
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		for section := range sections {
+			array := section.(ibus.IArraySection)
+			for _, ok := array.Next(context.Background()); ok; _, ok = array.Next(context.Background()) {
+			}
+		}
+		require.NoError(*secErr)
+		require.Equal(1, counter.sections)
+		require.Equal(2, counter.elements)
+	})
+
+	t.Run("Should pass through if nothing to intercept", func(t *testing.T) {
+		bus := Provide(Chain(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			sender.SendResponse(ibus.Response{Data: []byte("body")})
+		}, InterceptSender(SenderInterceptor{})))
+
+		resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("body", string(resp.Data))
+	})
+}
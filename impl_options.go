@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"fmt"
+
+	ibus "github.com/untillpro/airs-ibus"
+	"github.com/voedger/voedger/pkg/goutils/logger"
+)
+
+func (defaultLogger) Error(args ...interface{}) { logger.Error(args...) }
+
+func (defaultLogger) Warning(args ...interface{}) { logger.Warning(args...) }
+
+func (b *bus) onRequest(requestCtx context.Context, request ibus.Request) {
+	for _, h := range b.hooks {
+		if h.OnRequest != nil {
+			h.OnRequest(requestCtx, request)
+		}
+	}
+}
+
+func (b *bus) onRequestDone(requestCtx context.Context, request ibus.Request, response ibus.Response, err error) {
+	for _, h := range b.hooks {
+		if h.OnRequestDone != nil {
+			h.OnRequestDone(requestCtx, request, response, err)
+		}
+	}
+}
+
+func (b *bus) onPanic(requestCtx context.Context, panicErr *PanicError) {
+	for _, h := range b.hooks {
+		if h.OnPanic != nil {
+			h.OnPanic(requestCtx, panicErr)
+		}
+	}
+}
+
+func (s *resultSenderClosable) onPanic(panicErr *PanicError) {
+	for _, h := range s.hooks {
+		if h.OnPanic != nil {
+			h.OnPanic(s.requestCtx, panicErr)
+		}
+	}
+}
+
+func (s *resultSenderClosable) onStreamClose(err error) {
+	for _, h := range s.hooks {
+		if h.OnStreamClose != nil {
+			h.OnStreamClose(s.requestCtx, err)
+		}
+	}
+}
+
+func (s *resultSenderClosable) checkElementSize(size int) error {
+	if s.limits.MaxElementSize > 0 && size > s.limits.MaxElementSize {
+		return fmt.Errorf("%w: element of section %q is %d bytes, max %d", ErrLimitExceeded, s.sectionType, size, s.limits.MaxElementSize)
+	}
+	return nil
+}
+
+// called once the current section is about to be sent
+func (s *resultSenderClosable) checkSectionsAmount() error {
+	if s.limits.MaxSections > 0 && s.sentSections >= s.limits.MaxSections {
+		return fmt.Errorf("%w: section %q exceeds max %d sections", ErrLimitExceeded, s.sectionType, s.limits.MaxSections)
+	}
+	return nil
+}
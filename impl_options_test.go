@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+type testLogger struct {
+	sync.Mutex
+	errors   []string
+	warnings []string
+}
+
+func (l *testLogger) Error(args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.errors = append(l.errors, fmt.Sprint(args...))
+}
+
+func (l *testLogger) Warning(args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprint(args...))
+}
+
+func TestOptions_Logger(t *testing.T) {
+	require := require.New(t)
+	logger := &testLogger{}
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		panic("boom")
+	}, WithLogger(logger))
+
+	_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.EqualError(err, "boom")
+	require.Len(logger.errors, 1)
+	require.True(strings.HasPrefix(logger.errors[0], "handler panic:boom"))
+
+	require.Panics(func() { WithLogger(nil) })
+}
+
+func TestOptions_Middleware(t *testing.T) {
+	require := require.New(t)
+	addHeader := func(value string) Middleware {
+		return func(next ibus.RequestHandler) ibus.RequestHandler {
+			return func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+				request.Header = map[string][]string{"Trace": append(request.Header["Trace"], value)}
+				next(requestCtx, sender, request)
+			}
+		}
+	}
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		sender.SendResponse(ibus.Response{Data: []byte(strings.Join(request.Header["Trace"], ","))})
+	}, WithMiddleware(addHeader("m1"), addHeader("m2")), WithMiddleware(addHeader("m3")))
+
+	resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal("m1,m2,m3", string(resp.Data))
+
+	require.Panics(func() { WithMiddleware(nil) })
+}
+
+func TestOptions_Hooks(t *testing.T) {
+	require := require.New(t)
+	type ctxKeyTest struct{}
+	events := make(chan string, 10)
+	closeStream := make(chan struct{})
+	hooks := Hooks{
+		OnRequest: func(requestCtx context.Context, request ibus.Request) {
+			events <- "request " + request.Resource
+		},
+		OnRequestDone: func(requestCtx context.Context, request ibus.Request, response ibus.Response, err error) {
+			events <- fmt.Sprint("done ", request.Resource, " ", response.StatusCode, " ", err)
+		},
+		OnStreamClose: func(requestCtx context.Context, err error) {
+			events <- fmt.Sprint("close ", requestCtx.Value(ctxKeyTest{}), " ", err)
+		},
+	}
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "single" {
+			sender.SendResponse(ibus.Response{StatusCode: http.StatusOK})
+			return
+		}
+		rs := sender.SendParallelResponse()
+		go func() {
+			<-closeStream
+			rs.Close(ErrBusClosed)
+		}()
+	}, WithHooks(hooks), WithHooks(Hooks{
+		OnRequest: func(requestCtx context.Context, request ibus.Request) {
+			events <- "second hooks"
+		},
+	}))
+
+	_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "single"}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal("request single", <-events)
+	require.Equal("second hooks", <-events)
+	require.Equal("done single 200 <nil>", <-events)
+
+	ctx := context.WithValue(context.Background(), ctxKeyTest{}, "value")
+	_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{Resource: "sectioned"}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal("request sectioned", <-events)
+	require.Equal("second hooks", <-events)
+	require.Equal("done sectioned 0 <nil>", <-events)
+	close(closeStream)
+	for range sections {
+	}
+	require.Equal("close value bus closed", <-events)
+}
+
+func TestOptions_Limits(t *testing.T) {
+	require := require.New(t)
+	sendErrs := make(chan error, 10)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			defer close(sendErrs)
+			rs.StartArraySection("arr", nil)
+			sendErrs <- rs.SendElement("", "1234")
+			sendErrs <- rs.SendElement("", []byte("1234567"))
+			sendErrs <- rs.ObjectSection("obj", nil, 1)
+			sendErrs <- rs.ObjectSection("extra", nil, 1)
+			rs.Close(nil)
+		}()
+	}, WithLimits(Limits{MaxElementSize: 6, MaxSections: 2}))
+
+	ctx := context.Background()
+	_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	arr := (<-sections).(ibus.IArraySection)
+	value, ok := arr.Next(ctx)
+	require.True(ok)
+	require.Equal(`"1234"`, string(value))
+	require.NoError(<-sendErrs)
+	err = <-sendErrs
+	require.ErrorIs(err, ErrLimitExceeded)
+	require.Equal(`limit exceeded: element of section "arr" is 7 bytes, max 6`, err.Error())
+
+	obj := (<-sections).(ibus.IObjectSection)
+	require.Equal("1", string(obj.Value(ctx)))
+	require.NoError(<-sendErrs)
+	require.ErrorIs(<-sendErrs, ErrLimitExceeded)
+	_, ok = <-sections
+	require.False(ok)
+
+	require.Panics(func() { WithLimits(Limits{MaxElementSize: -1}) })
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// Go runs the producer of sections in its own goroutine and closes rs with the error returned by the producer
+// the producer panic is recovered and rs is closed with *BusError caused by *PanicError,
+// the panic is logged and reported to Hooks.OnPanic if rs is provided by the bus as is, i.e. not by SenderInterceptor
+// rs provided by the bus as is is not closed if the producer closes it itself
+func Go(rs ibus.IResultSenderClosable, producer func(rs ibus.IResultSender) error) {
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr := &PanicError{
+					Value: r,
+					Stack: debug.Stack(),
+				}
+				switch s := rs.(type) {
+				case *resultSenderClosable:
+					s.recovered(panicErr)
+				case *trackedSender:
+					s.recovered(panicErr)
+				}
+				err = handlePanic(panicErr)
+			}
+			closeProduced(rs, err)
+		}()
+		err = producer(rs)
+	}()
+}
+
+func closeProduced(rs ibus.IResultSenderClosable, err error) {
+	switch s := rs.(type) {
+	case *resultSenderClosable:
+		s.closeOpen(err)
+	case *trackedSender:
+		s.closeOpen(err)
+	default:
+		rs.Close(err)
+	}
+}
+
+// the stream closed already by the producer or by the bus is kept as is
+func (s *resultSenderClosable) closeOpen(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.close(err)
+	}
+}
+
+func (s *resultSenderClosable) recovered(panicErr *PanicError) {
+	panicErr.Request = s.request
+	s.logger.Error("producer panic:", fmt.Sprint(panicErr.Value), "\n", string(panicErr.Stack))
+	s.metrics.Panic()
+	s.onPanic(panicErr)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestGo(t *testing.T) {
+	require := require.New(t)
+	testErr := errors.New("test error")
+	logger := &testLogger{}
+	hooked := make(chan *PanicError, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		Go(sender.SendParallelResponse(), func(rs ibus.IResultSender) error {
+			if err := rs.ObjectSection("obj", nil, 1); err != nil {
+				return err
+			}
+			switch request.Resource {
+			case "panic":
+				panic("boom")
+			case "misuse":
+				rs.SendElement("", 2) // no section started
+			case "error":
+				return testErr
+			case "closed":
+				rs.(ibus.IResultSenderClosable).Close(testErr)
+			}
+			return nil
+		})
+	}, WithLogger(logger), WithHooks(Hooks{
+		OnPanic: func(requestCtx context.Context, panicErr *PanicError) {
+			hooked <- panicErr
+		},
+	}))
+
+	readAll := func(request ibus.Request) error {
+		ctx := context.Background()
+		_, sections, secErr, err := bus.SendRequest2(ctx, request, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("1", string((<-sections).(ibus.IObjectSection).Value(ctx)))
+		_, ok := <-sections
+		require.False(ok)
+		return *secErr
+	}
+
+	t.Run("Closed with the producer result", func(t *testing.T) {
+		require.NoError(readAll(ibus.Request{}))
+		require.ErrorIs(readAll(ibus.Request{Resource: "error"}), testErr)
+	})
+
+	t.Run("Closed by the producer", func(t *testing.T) {
+		require.ErrorIs(readAll(ibus.Request{Resource: "closed"}), testErr)
+	})
+
+	for _, resource := range []string{"panic", "misuse"} {
+		t.Run("Closed on "+resource, func(t *testing.T) {
+			request := ibus.Request{Resource: resource, WSID: 1}
+			err := readAll(request)
+
+			var busErr *BusError
+			require.ErrorAs(err, &busErr)
+			require.Equal(http.StatusInternalServerError, busErr.Status)
+			require.Equal(ErrorCodeHandlerPanic, busErr.Code)
+
+			var panicErr *PanicError
+			require.ErrorAs(err, &panicErr)
+			require.Equal(request, panicErr.Request)
+			require.Contains(string(panicErr.Stack), "TestGo")
+			require.Same(panicErr, <-hooked)
+		})
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	require.Len(logger.errors, 2)
+	require.True(strings.HasPrefix(logger.errors[0], "producer panic:boom"))
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func (r *router) Handle(method ibus.HTTPMethod, resourcePattern string, handler ibus.RequestHandler) {
+	if handler == nil {
+		panic("route handler must be not nil")
+	}
+	segments, err := parsePattern(resourcePattern)
+	if err != nil {
+		panic(err)
+	}
+	newRoute := &route{
+		method:   method,
+		pattern:  resourcePattern,
+		segments: segments,
+		handler:  handler,
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, existing := range r.routes {
+		if existing.method == newRoute.method && existing.sameSegments(newRoute) {
+			panic(fmt.Sprintf("route %s %s is already registered as %s", ibus.HTTPMethodToName[method], resourcePattern, existing.pattern))
+		}
+	}
+	r.routes = append(r.routes, newRoute)
+}
+
+func (r *router) HandleRequest(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+	resource := splitResource(request.Resource)
+	var matched *route
+	var params map[string]string
+	r.RLock()
+	for _, candidate := range r.routes {
+		if candidate.method != request.Method || (matched != nil && !candidate.moreSpecificThan(matched)) {
+			continue
+		}
+		if candidateParams, ok := candidate.match(resource); ok {
+			matched = candidate
+			params = candidateParams
+		}
+	}
+	r.RUnlock()
+	if matched == nil {
+		sender.SendResponse(ibus.CreateErrorResponse(http.StatusNotFound,
+			fmt.Errorf("route not found: %s %s", ibus.HTTPMethodToName[request.Method], request.Resource)))
+		return
+	}
+	route := Route{
+		Method:  matched.method,
+		Pattern: matched.pattern,
+		Params:  params,
+	}
+	matched.handler(context.WithValue(requestCtx, ctxKeyRoute, route), sender, request)
+}
+
+// MatchedRoute returns the route matched by IRouter for the request handled with requestCtx
+func MatchedRoute(requestCtx context.Context) (route Route, ok bool) {
+	route, ok = requestCtx.Value(ctxKeyRoute).(Route)
+	return
+}
+
+func parsePattern(pattern string) (segments []patternSegment, err error) {
+	parts := splitResource(pattern)
+	for i, part := range parts {
+		switch {
+		case part == wildcardSegment:
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("route pattern %s: wildcard must be the last segment", pattern)
+			}
+			segments = append(segments, patternSegment{kind: segmentWildcard})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if len(name) == 0 {
+				return nil, fmt.Errorf("route pattern %s: empty parameter name", pattern)
+			}
+			segments = append(segments, patternSegment{kind: segmentParam, value: name})
+		case strings.ContainsAny(part, "{}*"):
+			return nil, fmt.Errorf("route pattern %s: invalid segment %s", pattern, part)
+		default:
+			segments = append(segments, patternSegment{kind: segmentStatic, value: part})
+		}
+	}
+	return segments, nil
+}
+
+// leading and trailing separators are ignored
+func splitResource(resource string) []string {
+	resource = strings.Trim(resource, resourceSeparator)
+	if len(resource) == 0 {
+		return nil
+	}
+	return strings.Split(resource, resourceSeparator)
+}
+
+func (r *route) match(resource []string) (params map[string]string, ok bool) {
+	for i, segment := range r.segments {
+		if segment.kind == segmentWildcard {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[wildcardSegment] = strings.Join(resource[i:], resourceSeparator)
+			return params, true
+		}
+		if i >= len(resource) {
+			return nil, false
+		}
+		switch segment.kind {
+		case segmentStatic:
+			if segment.value != resource[i] {
+				return nil, false
+			}
+		case segmentParam:
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[segment.value] = resource[i]
+		}
+	}
+	return params, len(r.segments) == len(resource)
+}
+
+// static segment is more specific than parameter, parameter is more specific than wildcard
+// the earlier segment is more significant
+// routes of the same prefix match the same resource only if the longer one ends with the wildcard, e.g. "a" and "a/*", so the shorter one is more specific
+func (r *route) moreSpecificThan(other *route) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	return len(r.segments) < len(other.segments)
+}
+
+// parameter names do not matter: "a/{x}" and "a/{y}" are the same routes
+func (r *route) sameSegments(other *route) bool {
+	if len(r.segments) != len(other.segments) {
+		return false
+	}
+	for i, segment := range r.segments {
+		otherSegment := other.segments[i]
+		if segment.kind != otherSegment.kind || (segment.kind == segmentStatic && segment.value != otherSegment.value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestRouter_BasicUsage(t *testing.T) {
+	require := require.New(t)
+	router := NewRouter()
+	respondRoute := func(name string) ibus.RequestHandler {
+		return func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			route, ok := MatchedRoute(requestCtx)
+			require.True(ok)
+			data := name + " " + route.Pattern
+			for _, param := range []string{"id", "field", "*"} {
+				if value, ok := route.Params[param]; ok {
+					data += " " + param + "=" + value
+				}
+			}
+			sender.SendResponse(ibus.Response{Data: []byte(data)})
+		}
+	}
+	router.Handle(ibus.HTTPMethodGET, "articles", respondRoute("list"))
+	router.Handle(ibus.HTTPMethodPOST, "articles", respondRoute("create"))
+	router.Handle(ibus.HTTPMethodGET, "/articles/{id}", respondRoute("get"))
+	router.Handle(ibus.HTTPMethodGET, "articles/new", respondRoute("new"))
+	router.Handle(ibus.HTTPMethodGET, "articles/{id}/{field}", respondRoute("field"))
+	router.Handle(ibus.HTTPMethodGET, "articles/*", respondRoute("any"))
+	router.Handle(ibus.HTTPMethodGET, "*", respondRoute("root"))
+	bus := Provide(router.HandleRequest)
+
+	cases := []struct {
+		method   ibus.HTTPMethod
+		resource string
+		expected string
+	}{
+		{ibus.HTTPMethodGET, "articles", "list articles"},
+		{ibus.HTTPMethodPOST, "/articles/", "create articles"},
+		{ibus.HTTPMethodGET, "articles/42", "get /articles/{id} id=42"},
+		{ibus.HTTPMethodGET, "articles/new", "new articles/new"},
+		{ibus.HTTPMethodGET, "articles/42/name", "field articles/{id}/{field} id=42 field=name"},
+		{ibus.HTTPMethodGET, "articles/42/name/en", "any articles/* *=42/name/en"},
+		{ibus.HTTPMethodGET, "departments/1", "root * *=departments/1"},
+		{ibus.HTTPMethodGET, "", "root * *="},
+	}
+	for _, c := range cases {
+		t.Run(ibus.HTTPMethodToName[c.method]+" "+c.resource, func(t *testing.T) {
+			resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Method: c.method, Resource: c.resource}, ibus.DefaultTimeout)
+			require.NoError(err)
+			require.Equal(c.expected, string(resp.Data))
+		})
+	}
+}
+
+func TestRouter_RegistrationOrder(t *testing.T) {
+	require := require.New(t)
+	respond := func(data string) ibus.RequestHandler {
+		return func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			sender.SendResponse(ibus.Response{Data: []byte(data)})
+		}
+	}
+	patterns := []string{"a/*", "a", "a/{id}/*", "a/{id}", "a/b"}
+	expected := map[string]string{
+		"a":     "a",
+		"a/1":   "a/{id}",
+		"a/b":   "a/b",
+		"a/1/2": "a/{id}/*",
+		"b":     "",
+	}
+	for _, reversed := range []bool{false, true} {
+		router := NewRouter()
+		for i := range patterns {
+			pattern := patterns[i]
+			if reversed {
+				pattern = patterns[len(patterns)-1-i]
+			}
+			router.Handle(ibus.HTTPMethodGET, pattern, respond(pattern))
+		}
+		bus := Provide(router.HandleRequest)
+		for resource, pattern := range expected {
+			resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Method: ibus.HTTPMethodGET, Resource: resource}, ibus.DefaultTimeout)
+			require.NoError(err)
+			if pattern == "" {
+				require.Equal(http.StatusNotFound, resp.StatusCode)
+				continue
+			}
+			require.Equal(pattern, string(resp.Data), "resource %s, reversed %v", resource, reversed)
+		}
+	}
+}
+
+func TestRouter_NotFound(t *testing.T) {
+	require := require.New(t)
+	router := NewRouter()
+	router.Handle(ibus.HTTPMethodGET, "articles/{id}", func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		sender.SendResponse(ibus.Response{})
+	})
+	bus := Provide(router.HandleRequest)
+
+	for _, request := range []ibus.Request{
+		{Method: ibus.HTTPMethodGET, Resource: "articles"},
+		{Method: ibus.HTTPMethodGET, Resource: "articles/1/2"},
+		{Method: ibus.HTTPMethodPOST, Resource: "articles/1"},
+	} {
+		resp, sections, _, err := bus.SendRequest2(context.Background(), request, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Nil(sections)
+		require.Equal(http.StatusNotFound, resp.StatusCode)
+		require.Contains(string(resp.Data), request.Resource)
+	}
+}
+
+func TestRouter_Handle(t *testing.T) {
+	require := require.New(t)
+	handler := func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {}
+	router := NewRouter()
+	router.Handle(ibus.HTTPMethodGET, "a/{id}", handler)
+
+	t.Run("Should panic on the same route", func(t *testing.T) {
+		require.Panics(func() { router.Handle(ibus.HTTPMethodGET, "a/{other}", handler) })
+		require.NotPanics(func() { router.Handle(ibus.HTTPMethodPUT, "a/{other}", handler) })
+	})
+	t.Run("Should panic on nil handler", func(t *testing.T) {
+		require.Panics(func() { router.Handle(ibus.HTTPMethodGET, "b", nil) })
+	})
+	t.Run("Should panic on invalid pattern", func(t *testing.T) {
+		for _, pattern := range []string{"a/*/b", "a/{}", "a/b{c}", "a/b*"} {
+			require.Panics(func() { router.Handle(ibus.HTTPMethodGET, pattern, handler) }, pattern)
+		}
+	})
+	t.Run("No matched route out of router", func(t *testing.T) {
+		_, ok := MatchedRoute(context.Background())
+		require.False(ok)
+	})
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import "fmt"
+
+// returns ErrProtocolViolation if the response is sent already
+func (s *channelSender) respond() error {
+	if s.responded.CompareAndSwap(false, true) {
+		return nil
+	}
+	return protocolViolation(s.safeMode, s.logger, "response is sent already")
+}
+
+// must be called under the stream lock
+func (s *resultSenderClosable) violation(misuse string) error {
+	return protocolViolation(s.safeMode, s.logger, misuse)
+}
+
+// the misuse panics unless the safe mode is on
+func protocolViolation(safeMode bool, logger ILogger, misuse string) error {
+	err := fmt.Errorf("%w: %s", ErrProtocolViolation, misuse)
+	if !safeMode {
+		panic(err)
+	}
+	logger.Error(err)
+	return toBusError(err)
+}
+
+func (s *violatedSender) StartArraySection(sectionType string, path []string) {}
+
+func (s *violatedSender) StartMapSection(sectionType string, path []string) {}
+
+func (s *violatedSender) ObjectSection(sectionType string, path []string, element interface{}) error {
+	return s.err
+}
+
+func (s *violatedSender) SendElement(name string, element interface{}) error {
+	return s.err
+}
+
+func (s *violatedSender) Close(err error) {}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestSafeMode(t *testing.T) {
+	require := require.New(t)
+	logger := &testLogger{}
+	misuseErrs := make(chan error, 10)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "single" {
+			sender.SendResponse(ibus.Response{Data: []byte("first")})
+			sender.SendResponse(ibus.Response{Data: []byte("second")})
+			misuseErrs <- sender.SendParallelResponse().SendElement("", 1)
+			return
+		}
+		rs := sender.SendParallelResponse()
+		sender.SendResponse(ibus.Response{})
+		misuseErrs <- sender.SendParallelResponse().ObjectSection("obj", nil, 1)
+		go func() {
+			defer close(misuseErrs)
+			misuseErrs <- rs.SendElement("", 1)
+			require.NoError(rs.ObjectSection("obj", nil, 1))
+			misuseErrs <- rs.SendElement("", 2)
+			rs.Close(nil)
+
+			rs.Close(nil)
+			rs.StartArraySection("arr", nil)
+			rs.StartMapSection("map", nil)
+			misuseErrs <- rs.ObjectSection("obj", nil, 1)
+			misuseErrs <- rs.SendElement("", nil)
+		}()
+	}, WithSafeMode(), WithLogger(logger))
+
+	t.Run("Single response", func(t *testing.T) {
+		resp, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "single"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("first", string(resp.Data))
+		err = <-misuseErrs
+		require.ErrorIs(err, ErrProtocolViolation)
+		require.Equal("protocol violation: response is sent already", err.Error())
+	})
+
+	t.Run("Sectioned response", func(t *testing.T) {
+		ctx := context.Background()
+		_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("1", string((<-sections).(ibus.IObjectSection).Value(ctx)))
+		for range sections {
+		}
+		require.NoError(*secErr)
+
+		var messages []string
+		for err := range misuseErrs {
+			var busErr *BusError
+			require.ErrorAs(err, &busErr)
+			require.Equal(http.StatusInternalServerError, busErr.Status)
+			require.Equal(ErrorCodeProtocolViolation, busErr.Code)
+			messages = append(messages, err.Error())
+		}
+		require.Equal([]string{
+			"protocol violation: response is sent already",
+			"protocol violation: section is not started",
+			"protocol violation: section is not started",
+			"protocol violation: section is sent after Close",
+			"protocol violation: element is sent after Close",
+		}, messages)
+	})
+
+	logger.Lock()
+	defer logger.Unlock()
+	require.Equal([]string{
+		"protocol violation: response is sent already",
+		"protocol violation: response is sent already",
+		"protocol violation: response is sent already",
+		"protocol violation: response is sent already",
+		"protocol violation: section is not started",
+		"protocol violation: section is not started",
+		"protocol violation: stream is closed already",
+		"protocol violation: section is started after Close",
+		"protocol violation: section is started after Close",
+		"protocol violation: section is sent after Close",
+		"protocol violation: element is sent after Close",
+	}, logger.errors)
+}
+
+func TestSafeMode_Off(t *testing.T) {
+	require := require.New(t)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		require.PanicsWithError("protocol violation: response is sent already", func() { sender.SendResponse(ibus.Response{}) })
+		require.PanicsWithError("protocol violation: section is not started", func() { rs.SendElement("", 1) })
+		rs.Close(nil)
+		require.PanicsWithError("protocol violation: stream is closed already", func() { rs.Close(nil) })
+	})
+
+	_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+	require.NoError(err)
+	for range sections {
+	}
+}
@@ -138,16 +138,26 @@ func TestBasicUsage(t *testing.T) {
 		require.Panics(func() { Provide(nil) })
 	})
 	t.Run("Should return timeout error if no response at all", func(t *testing.T) {
-		bus := provide(func(srequestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		clock := NewManualClock(time.Now())
+		bus := Provide(func(srequestCtx context.Context, sender ibus.ISender, request ibus.Request) {
 			// do not send response to trigger the timeout case
-		}, timeoutTrigger, time.After, time.After)
+		}, WithClock(clock))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			response, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
 
-		response, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
+			require.ErrorIs(err, ibus.ErrBusTimeoutExpired)
+			require.Empty(response)
+			require.Nil(sections)
+			require.Nil(secErr)
+		}()
 
-		require.Equal(ibus.ErrBusTimeoutExpired, err)
-		require.Empty(response)
-		require.Nil(sections)
-		require.Nil(secErr)
+		clock.BlockUntil(1) // response timer
+		clock.Advance(ibus.DefaultTimeout - time.Nanosecond)
+		require.Never(func() bool { return isClosed(done) }, 50*time.Millisecond, time.Millisecond)
+		clock.Advance(time.Nanosecond)
+		<-done
 	})
 }
 
@@ -198,7 +208,8 @@ func TestResultSenderClosable_StartArraySection(t *testing.T) {
 	require := require.New(t)
 	t.Run("Should return timeout error on long section read", func(t *testing.T) {
 		ch := make(chan interface{})
-		bus := provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		clock := NewManualClock(time.Now())
+		bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
 			rs := sender.SendParallelResponse()
 			go func() {
 				err := rs.ObjectSection("", nil, 42)
@@ -206,12 +217,14 @@ func TestResultSenderClosable_StartArraySection(t *testing.T) {
 				require.ErrorIs(err, ibus.ErrNoConsumer)
 				rs.Close(nil)
 			}()
-		}, time.After, timeoutTrigger, time.After)
+		}, WithClock(clock))
 		resp, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
 		require.NoError(err)
 		require.NotNil(sections)
 		require.Empty(resp)
-		<-ch // do not read section to trigger the timeout case
+		clock.BlockUntil(1) // do not read section to trigger the timeout case
+		clock.Advance(ibus.DefaultTimeout)
+		<-ch
 		_, ok := <-sections
 		require.False(ok)
 		require.NoError(*secErr)
@@ -298,21 +311,26 @@ func TestResultSenderClosable_SendElement(t *testing.T) {
 		require.NoError(*secErr)
 	})
 	t.Run("Should return error when client reads element too long", func(t *testing.T) {
-		bus := provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		clock := NewManualClock(time.Now())
+		bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
 			rs := sender.SendParallelResponse()
 			go func() {
 				rs.StartArraySection("", nil)
 				require.ErrorIs(rs.SendElement("", 0), ibus.ErrNoConsumer)
 				rs.Close(nil)
 			}()
-		}, time.After, time.After, timeoutTrigger)
+		}, WithClock(clock))
 
 		response, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{}, ibus.DefaultTimeout)
 
 		require.NoError(err)
 		require.Empty(response)
+		clock.BlockUntil(1) // the section send waits for the client
+		arms := clock.Arms()
 		_ = (<-sections).(ibus.IArraySection)
 		// do not read an element to trigger timeout
+		clock.BlockUntilArms(arms + 1) // the timer of the section send could be still armed
+		clock.Advance(ibus.DefaultTimeout)
 		_, ok := <-sections
 		require.False(ok)
 		require.NoError(*secErr)
@@ -432,8 +450,11 @@ func TestClientDisconnectOnSectionsSending(t *testing.T) {
 	<-ch
 }
 
-func timeoutTrigger(d time.Duration) <-chan time.Time {
-	res := make(chan time.Time)
-	close(res)
-	return res
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"time"
+)
+
+// ContextWithTimeouts returns ctx which makes SendRequest2 to use non-zero timeouts instead of ones configured by WithTimeouts
+func ContextWithTimeouts(ctx context.Context, timeouts Timeouts) context.Context {
+	return context.WithValue(ctx, ctxKeyTimeouts, timeouts)
+}
+
+// TimeoutsFromContext returns timeouts provided by ContextWithTimeouts
+func TimeoutsFromContext(ctx context.Context) (timeouts Timeouts, ok bool) {
+	timeouts, ok = ctx.Value(ctxKeyTimeouts).(Timeouts)
+	return timeouts, ok
+}
+
+// timeouts of the client ctx take priority over timeouts of the bus, timeout of SendRequest2 is used for the rest
+func (b *bus) requestTimeouts(clientCtx context.Context, timeout time.Duration) Timeouts {
+	res := b.timeouts
+	if ctxTimeouts, ok := TimeoutsFromContext(clientCtx); ok {
+		res = res.overriddenBy(ctxTimeouts)
+	}
+	return res.withDefault(timeout)
+}
+
+func (t Timeouts) overriddenBy(other Timeouts) Timeouts {
+	if other.Response > 0 {
+		t.Response = other.Response
+	}
+	if other.Section > 0 {
+		t.Section = other.Section
+	}
+	if other.Element > 0 {
+		t.Element = other.Element
+	}
+	if other.Stream > 0 {
+		t.Stream = other.Stream
+	}
+	return t
+}
+
+func (s *resultSenderClosable) sectionTimeout() <-chan time.Time {
+	return s.startTimeout(s.timeouts.Section)
+}
+
+func (s *resultSenderClosable) elementTimeout() <-chan time.Time {
+	return s.startTimeout(s.timeouts.Element)
+}
+
+// the stream timer is reused by all sends, its deadline is fired by the timer shared by streams of the bus
+func (s *resultSenderClosable) startTimeout(d time.Duration) <-chan time.Time {
+	if s.timer == nil {
+		s.timer = s.deadlines.newTimer()
+	}
+	return s.timer.reset(d)
+}
+
+// must be called once the send which armed the timer is finished
+func (s *resultSenderClosable) stopTimeout() {
+	if s.timer != nil {
+		s.timer.stop()
+	}
+}
+
+func (t Timeouts) withDefault(timeout time.Duration) Timeouts {
+	return Timeouts{Response: timeout, Section: timeout, Element: timeout}.overriddenBy(t)
+}
+
+// blocked sends are released first, then the stream is closed once the producer returns from the current send
+func (s *resultSenderClosable) expire() {
+	close(s.deadlineExceeded)
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.close(toBusError(ErrStreamDeadlineExceeded))
+	}
+}
+
+// further sends return ErrStreamDeadlineExceeded instead of panic on the closed stream
+func (s *resultSenderClosable) isExpired() bool {
+	select {
+	case <-s.deadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestTimeouts_Response(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		// do not send response to trigger the timeout case
+	}, WithClock(clock), WithTimeouts(Timeouts{Response: time.Second}))
+
+	sendRequest := func(ctx context.Context) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, _, _, err := bus.SendRequest2(ctx, ibus.Request{}, time.Hour)
+			errs <- err
+		}()
+		clock.BlockUntil(1)
+		return errs
+	}
+
+	t.Run("Timeout of the bus", func(t *testing.T) {
+		errs := sendRequest(context.Background())
+		requireFiresAfter(t, clock, time.Second, errs)
+		require.ErrorIs(<-errs, ibus.ErrBusTimeoutExpired)
+	})
+
+	t.Run("Timeout of the request ctx", func(t *testing.T) {
+		ctx := ContextWithTimeouts(context.Background(), Timeouts{Response: 3 * time.Second, Element: time.Minute})
+		timeouts, ok := TimeoutsFromContext(ctx)
+		require.True(ok)
+		require.Equal(time.Minute, timeouts.Element)
+
+		errs := sendRequest(ctx)
+		requireFiresAfter(t, clock, 3*time.Second, errs)
+		require.ErrorIs(<-errs, ibus.ErrBusTimeoutExpired)
+	})
+
+	t.Run("Should panic on wrong config", func(t *testing.T) {
+		require.Panics(func() { WithTimeouts(Timeouts{Element: -1}) })
+	})
+}
+
+func TestTimeouts_SectionAndElement(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	sendErrs := make(chan error, 10)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			defer rs.Close(nil)
+			rs.StartArraySection("arr", nil)
+			require.NoError(rs.SendElement("", 1))
+			if request.Resource == "section" {
+				sendErrs <- rs.ObjectSection("obj", nil, 2)
+				return
+			}
+			sendErrs <- rs.SendElement("", 2)
+		}()
+	}, WithClock(clock), WithTimeouts(Timeouts{Section: 2 * time.Second, Element: 5 * time.Second}))
+
+	for resource, timeout := range map[string]time.Duration{
+		"section": 2 * time.Second,
+		"element": 5 * time.Second,
+	} {
+		t.Run(resource, func(t *testing.T) {
+			ctx := context.Background()
+			_, sections, _, err := bus.SendRequest2(ctx, ibus.Request{Resource: resource}, time.Hour)
+			require.NoError(err)
+			clock.BlockUntil(1) // the section send waits for the client
+			arms := clock.Arms()
+			arr := (<-sections).(ibus.IArraySection)
+			clock.BlockUntilArms(arms + 1) // the timer of the section send could be still armed
+			arms = clock.Arms()
+			_, ok := arr.Next(ctx)
+			require.True(ok)
+			clock.BlockUntilArms(arms + 1) // the timer of the first element send could be still armed
+			requireFiresAfter(t, clock, timeout, sendErrs)
+			require.ErrorIs(<-sendErrs, ibus.ErrNoConsumer)
+			for range sections {
+			}
+		})
+	}
+}
+
+// the time is moved up to d and the fire is checked just before and exactly at d
+func requireFiresAfter[T any](t *testing.T, clock IManualClock, d time.Duration, fired <-chan T) {
+	clock.Advance(d - time.Nanosecond)
+	require.Never(t, func() bool { return len(fired) > 0 }, 50*time.Millisecond, time.Millisecond)
+	clock.Advance(time.Nanosecond)
+	require.Eventually(t, func() bool { return len(fired) > 0 }, time.Second, time.Millisecond)
+}
+
+func TestTimeouts_Stream(t *testing.T) {
+	require := require.New(t)
+	clock := NewManualClock(time.Now())
+	sendErrs := make(chan error, 10)
+	proceed := make(chan struct{})
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		rs := sender.SendParallelResponse()
+		go func() {
+			if request.Resource == "idle" {
+				require.NoError(rs.ObjectSection("first", nil, 1))
+				<-proceed
+			}
+			sendErrs <- rs.ObjectSection("second", nil, 2)
+			rs.StartArraySection("ignored", nil)
+			sendErrs <- rs.SendElement("", 3)
+			rs.Close(nil)
+		}()
+	}, WithClock(clock), WithTimeouts(Timeouts{Stream: 10 * time.Second}))
+
+	t.Run("Should close the idle stream", func(t *testing.T) {
+		ctx := context.Background()
+		_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{Resource: "idle"}, time.Hour)
+		require.NoError(err)
+		require.Equal("1", string((<-sections).(ibus.IObjectSection).Value(ctx)))
+
+		clock.Advance(10 * time.Second)
+		_, ok := <-sections
+		require.False(ok)
+		require.ErrorIs(*secErr, ErrStreamDeadlineExceeded)
+
+		close(proceed)
+		require.ErrorIs(<-sendErrs, ErrStreamDeadlineExceeded)
+		require.ErrorIs(<-sendErrs, ErrStreamDeadlineExceeded)
+	})
+
+	t.Run("Should release the blocked send", func(t *testing.T) {
+		_, sections, secErr, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "blocked"}, time.Hour)
+		require.NoError(err)
+		clock.BlockUntil(2) // the stream deadline and the section send
+		requireFiresAfter(t, clock, 10*time.Second, sendErrs)
+		require.ErrorIs(<-sendErrs, ErrStreamDeadlineExceeded)
+		require.ErrorIs(<-sendErrs, ErrStreamDeadlineExceeded)
+		_, ok := <-sections
+		require.False(ok)
+		require.ErrorIs(*secErr, ErrStreamDeadlineExceeded)
+	})
+
+	t.Run("Should close the stream expired on the start", func(t *testing.T) {
+		tracer := NewInMemoryTracer()
+		bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			sender.SendParallelResponse() // closed by the deadline
+		}, WithClock(immediateClock{SystemClock}), WithTracer(tracer), WithTimeouts(Timeouts{Stream: time.Hour}))
+		for i := 0; i < 100; i++ {
+			_, sections, _, err := bus.SendRequest2(context.Background(), ibus.Request{}, time.Hour)
+			require.NoError(err)
+			for range sections {
+			}
+		}
+
+		// the stream span is ended and the request scope is released by the stream closed by the deadline as well
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(bus.Shutdown(ctx))
+		streams := 0
+		for _, span := range tracer.Spans() {
+			if span.Name == spanStream {
+				streams++
+			}
+		}
+		require.Equal(100, streams)
+	})
+
+	t.Run("Should not be used if the stream is closed", func(t *testing.T) {
+		bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+			rs := sender.SendParallelResponse()
+			rs.Close(nil)
+		}, WithClock(clock))
+		ctx := ContextWithTimeouts(context.Background(), Timeouts{Stream: time.Second})
+		_, sections, secErr, err := bus.SendRequest2(ctx, ibus.Request{}, time.Hour)
+		require.NoError(err)
+		for range sections {
+		}
+		clock.Advance(time.Second)
+		require.NoError(*secErr)
+	})
+}
+
+// AfterFunc callbacks are called at once
+type immediateClock struct {
+	IClock
+}
+
+func (c immediateClock) AfterFunc(d time.Duration, f func()) ITimer {
+	go f()
+	return c.IClock.AfterFunc(d, func() {})
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// ContextWithSpan returns ctx which contains the span
+// ITracer implementations should return such ctx from Start
+func ContextWithSpan(ctx context.Context, span ISpan) context.Context {
+	return context.WithValue(ctx, ctxKeySpan, span)
+}
+
+// SpanFromContext returns the span started by ITracer, e.g. the SendRequest2 span for the requestCtx of the request handler
+func SpanFromContext(ctx context.Context) (span ISpan, ok bool) {
+	span, ok = ctx.Value(ctxKeySpan).(ISpan)
+	return
+}
+
+// ContextWithRemoteSpanContext returns ctx which contains the span context received from the other process
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, ctxKeyRemoteSpanContext, sc)
+}
+
+// ParentSpanContext returns the context of the span from ctx or the remote span context if there is no span in ctx
+func ParentSpanContext(ctx context.Context) (sc SpanContext, ok bool) {
+	if span, ok := SpanFromContext(ctx); ok {
+		return span.SpanContext(), true
+	}
+	sc, ok = ctx.Value(ctxKeyRemoteSpanContext).(SpanContext)
+	return sc, ok
+}
+
+// ParseTraceParent parses W3C traceparent header value
+func ParseTraceParent(traceParent string) (sc SpanContext, err error) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || parts[0] != traceParentVersion || len(parts[1]) != hex.EncodedLen(len(sc.TraceID)) ||
+		len(parts[2]) != hex.EncodedLen(len(sc.SpanID)) || len(parts[3]) != hex.EncodedLen(1) {
+		return sc, fmt.Errorf("invalid traceparent %q", traceParent)
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", traceParent, err)
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", traceParent, err)
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", traceParent, err)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q: zero trace or span ID", traceParent)
+	}
+	sc.Sampled = flags&traceFlagSampled != 0
+	return sc, nil
+}
+
+// TraceParent returns W3C traceparent header value, e.g. to send it in ibus.Request.Header
+func (sc SpanContext) TraceParent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = traceFlagSampled
+	}
+	return fmt.Sprintf("%s-%s-%s-%02x", traceParentVersion, sc.TraceID, sc.SpanID, flags)
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// the span of SendRequest2 is a child of the remote span provided by the traceparent request header
+// end must be called with the error returned by SendRequest2
+func (b *bus) startRequestSpan(requestCtx context.Context, request ibus.Request) (ctx context.Context, end func(err error)) {
+	if b.tracer == nil {
+		return requestCtx, func(error) {}
+	}
+	if sc, ok := spanContextFromHeader(request.Header); ok {
+		requestCtx = ContextWithRemoteSpanContext(requestCtx, sc)
+	}
+	ctx, span := b.tracer.Start(requestCtx, spanRequest, requestAttributes(request)...)
+	return ctx, func(err error) {
+		span.SetError(err)
+		span.End()
+	}
+}
+
+// header names are case-insensitive
+func spanContextFromHeader(header map[string][]string) (sc SpanContext, ok bool) {
+	for name, values := range header {
+		if len(values) > 0 && strings.EqualFold(name, traceParentHeader) {
+			sc, err := ParseTraceParent(values[0])
+			return sc, err == nil
+		}
+	}
+	return sc, false
+}
+
+func requestAttributes(request ibus.Request) []Attribute {
+	return []Attribute{
+		{Key: "ibus.method", Value: ibus.HTTPMethodToName[request.Method]},
+		{Key: "ibus.resource", Value: request.Resource},
+		{Key: "ibus.queue_id", Value: request.QueueID},
+		{Key: "ibus.wsid", Value: strconv.FormatUint(uint64(request.WSID), 10)},
+		{Key: "ibus.partition_id", Value: strconv.FormatUint(uint64(request.PartitionID), 10)},
+	}
+}
+
+func sectionAttributes(kind ibus.SectionKind, sectionType string, path []string) []Attribute {
+	return []Attribute{
+		{Key: "ibus.section.kind", Value: sectionKindLabels[kind]},
+		{Key: "ibus.section.type", Value: sectionType},
+		{Key: "ibus.section.path", Value: strings.Join(path, resourceSeparator)},
+	}
+}
+
+func errorAttributes(err error) []Attribute {
+	if err == nil {
+		return nil
+	}
+	return []Attribute{{Key: "error", Value: err.Error()}}
+}
+
+// previous section span is ended
+func (s *resultSenderClosable) startSectionSpan(kind ibus.SectionKind, sectionType string, path []string) {
+	if s.tracer == nil {
+		return
+	}
+	s.endSectionSpan()
+	_, s.sectionSpan = s.tracer.Start(s.streamCtx, spanSection, sectionAttributes(kind, sectionType, path)...)
+	s.sectionElems = 0
+}
+
+func (s *resultSenderClosable) endSectionSpan() {
+	if s.sectionSpan == nil {
+		return
+	}
+	s.sectionSpan.SetAttributes(Attribute{Key: "ibus.section.elements", Value: strconv.Itoa(s.sectionElems)})
+	s.sectionSpan.End()
+	s.sectionSpan = nil
+}
+
+func (s *resultSenderClosable) traceElement(err error) {
+	if s.sectionSpan == nil {
+		return
+	}
+	if err != nil {
+		s.sectionSpan.SetError(err)
+		return
+	}
+	s.sectionElems++
+}
+
+func (s *resultSenderClosable) traceClose(err error) {
+	if s.tracer == nil {
+		return
+	}
+	s.endSectionSpan()
+	s.streamSpan.AddEvent(eventClose, errorAttributes(err)...)
+	s.streamSpan.SetError(err)
+	s.streamSpan.End()
+}
+
+func (t *inMemoryTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, ISpan) {
+	span := &inMemorySpan{
+		tracer: t,
+		data: SpanData{
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: attrs,
+		},
+	}
+	span.data.SpanContext.Sampled = true
+	if parent, ok := ParentSpanContext(ctx); ok {
+		span.data.Parent = parent
+		span.data.SpanContext.TraceID = parent.TraceID
+	} else {
+		randomID(span.data.SpanContext.TraceID[:])
+	}
+	randomID(span.data.SpanContext.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *inMemoryTracer) Spans() []SpanData {
+	t.Lock()
+	defer t.Unlock()
+	return append([]SpanData(nil), t.spans...)
+}
+
+func (t *inMemoryTracer) Reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.spans = nil
+}
+
+func (s *inMemorySpan) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+// changes after End are ignored
+func (s *inMemorySpan) SetAttributes(attrs ...Attribute) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.ended {
+		s.data.Attributes = append(s.data.Attributes, attrs...)
+	}
+}
+
+func (s *inMemorySpan) AddEvent(name string, attrs ...Attribute) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.ended {
+		s.data.Events = append(s.data.Events, SpanEvent{Name: name, Time: time.Now(), Attributes: attrs})
+	}
+}
+
+func (s *inMemorySpan) SetError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.ended && err != nil {
+		s.data.Err = err
+	}
+}
+
+func (s *inMemorySpan) End() {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.Unlock()
+
+	s.tracer.Lock()
+	s.tracer.spans = append(s.tracer.spans, data)
+	s.tracer.Unlock()
+}
+
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		// notest
+		panic(err)
+	}
+}
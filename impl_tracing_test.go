@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+func TestTracing_SectionedResponse(t *testing.T) {
+	require := require.New(t)
+	tracer := NewInMemoryTracer()
+	testErr := errors.New("test error")
+	handlerSpanContext := make(chan SpanContext, 1)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		span, ok := SpanFromContext(requestCtx)
+		require.True(ok)
+		handlerSpanContext <- span.SpanContext()
+		rs := sender.SendParallelResponse()
+		go func() {
+			rs.StartArraySection("arr", []string{"a", "b"})
+			require.NoError(rs.SendElement("", 1))
+			require.NoError(rs.SendElement("", 2))
+			require.NoError(rs.ObjectSection("obj", nil, 3))
+			rs.StartMapSection("map", nil)
+			require.NoError(rs.SendElement("k", 4))
+			rs.Close(testErr)
+		}()
+	}, WithTracer(tracer))
+
+	remote := SpanContext{TraceID: TraceID{1, 2, 3}, SpanID: SpanID{4, 5, 6}, Sampled: true}
+	request := ibus.Request{
+		Resource: "articles",
+		Header:   map[string][]string{"Traceparent": {remote.TraceParent()}},
+	}
+	_, sections, secErr, err := bus.SendRequest2(context.Background(), request, ibus.DefaultTimeout)
+	require.NoError(err)
+	readAllSections(sections)
+	require.ErrorIs(*secErr, testErr)
+
+	spans := tracer.Spans()
+	require.Len(spans, 5)
+	byName := map[string][]SpanData{}
+	for _, span := range spans {
+		require.Equal(remote.TraceID, span.SpanContext.TraceID, "all spans belong to the remote trace")
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+
+	requestSpan := byName[spanRequest][0]
+	require.Equal(remote, requestSpan.Parent)
+	require.Equal(requestSpan.SpanContext, <-handlerSpanContext)
+	require.Contains(requestSpan.Attributes, Attribute{Key: "ibus.resource", Value: "articles"})
+	require.NoError(requestSpan.Err)
+
+	streamSpan := byName[spanStream][0]
+	require.Equal(requestSpan.SpanContext, streamSpan.Parent)
+	require.ErrorIs(streamSpan.Err, testErr)
+	require.Len(streamSpan.Events, 1)
+	require.Equal(eventClose, streamSpan.Events[0].Name)
+	require.Equal([]Attribute{{Key: "error", Value: "test error"}}, streamSpan.Events[0].Attributes)
+
+	sectionSpans := byName[spanSection]
+	require.Len(sectionSpans, 3)
+	expected := []struct {
+		kind     string
+		elements string
+	}{{"array", "2"}, {"object", "1"}, {"map", "1"}}
+	for i, span := range sectionSpans {
+		require.Equal(streamSpan.SpanContext, span.Parent)
+		require.Contains(span.Attributes, Attribute{Key: "ibus.section.kind", Value: expected[i].kind})
+		require.Contains(span.Attributes, Attribute{Key: "ibus.section.elements", Value: expected[i].elements})
+	}
+	require.Contains(sectionSpans[0].Attributes, Attribute{Key: "ibus.section.path", Value: "a/b"})
+}
+
+func TestTracing_Response(t *testing.T) {
+	require := require.New(t)
+	tracer := NewInMemoryTracer()
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "panic" {
+			panic("boom")
+		}
+		sender.SendResponse(ibus.CreateResponse(201, "created"))
+	}, WithTracer(tracer))
+
+	t.Run("Should start new trace if no traceparent", func(t *testing.T) {
+		_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Header: map[string][]string{"traceparent": {"invalid"}}}, ibus.DefaultTimeout)
+		require.NoError(err)
+		spans := tracer.Spans()
+		require.Len(spans, 1)
+		require.True(spans[0].SpanContext.IsValid())
+		require.False(spans[0].Parent.IsValid())
+		require.Len(spans[0].Events, 1)
+		require.Equal([]Attribute{{Key: "ibus.status_code", Value: "201"}}, spans[0].Events[0].Attributes)
+	})
+
+	t.Run("Should record the error", func(t *testing.T) {
+		tracer.Reset()
+		_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{Resource: "panic"}, ibus.DefaultTimeout)
+		require.Error(err)
+		spans := tracer.Spans()
+		require.Len(spans, 1)
+		require.Equal(err, spans[0].Err)
+	})
+}
+
+func TestParseTraceParent(t *testing.T) {
+	require := require.New(t)
+	sc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(err)
+	require.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.Equal("00f067aa0ba902b7", sc.SpanID.String())
+	require.True(sc.Sampled)
+	require.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.TraceParent())
+
+	sc.Sampled = false
+	require.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", sc.TraceParent())
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-xx",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceParent(invalid)
+		require.Error(err, invalid)
+	}
+}
+
+func TestInMemorySpan_ShouldIgnoreChangesAfterEnd(t *testing.T) {
+	require := require.New(t)
+	tracer := NewInMemoryTracer()
+	_, span := tracer.Start(context.Background(), "test")
+	span.End()
+	span.SetAttributes(Attribute{Key: "k", Value: "v"})
+	span.AddEvent("event")
+	span.SetError(errors.New("error"))
+	span.End()
+
+	spans := tracer.Spans()
+	require.Len(spans, 1)
+	require.Empty(spans[0].Attributes)
+	require.Empty(spans[0].Events)
+	require.NoError(spans[0].Err)
+}
+
+func TestWithTracer_ShouldPanicOnNil(t *testing.T) {
+	require.Panics(t, func() { WithTracer(nil) })
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"sync"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// PartitionKeyPartitionID is the partition key func for WithWorkerPool which partitions requests by ibus.Request.PartitionID
+func PartitionKeyPartitionID(request ibus.Request) uint64 {
+	return uint64(request.PartitionID)
+}
+
+// PartitionKeyWSID is the partition key func for WithWorkerPool which partitions requests by ibus.Request.WSID
+func PartitionKeyWSID(request ibus.Request) uint64 {
+	return uint64(request.WSID)
+}
+
+func newWorkerPool(workers int, maxQueueLen int, partitionKey func(request ibus.Request) uint64) *workerPool {
+	p := &workerPool{
+		partitionKey: partitionKey,
+		maxQueueLen:  maxQueueLen,
+		partitions:   map[uint64]*partitionQueue{},
+	}
+	p.cond = sync.NewCond(p)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// task is queued to the partition of the request
+// ErrBusBusy is returned if the partition queue is full
+func (p *workerPool) submit(request ibus.Request, task func()) error {
+	key := p.partitionKey(request)
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return ErrBusClosed
+	}
+	q, ok := p.partitions[key]
+	if !ok {
+		q = &partitionQueue{key: key}
+		p.partitions[key] = q
+	}
+	if len(q.tasks) >= p.maxQueueLen {
+		return ErrBusBusy
+	}
+	q.tasks = append(q.tasks, task)
+	if !q.scheduled {
+		q.scheduled = true
+		p.ready = append(p.ready, q)
+		p.cond.Signal()
+	}
+	return nil
+}
+
+// worker takes one task of the first ready partition at a time to not to starve other partitions
+// partition is not ready while its task is processed so tasks of the same partition are never processed simultaneously
+func (p *workerPool) work() {
+	p.Lock()
+	defer p.Unlock()
+	for {
+		for len(p.ready) == 0 {
+			if p.stopped {
+				return
+			}
+			p.cond.Wait()
+		}
+		q := p.ready[0]
+		p.ready[0] = nil
+		p.ready = p.ready[1:]
+		task := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+
+		p.Unlock()
+		task()
+		p.Lock()
+
+		if len(q.tasks) > 0 {
+			p.ready = append(p.ready, q)
+			p.cond.Signal()
+		} else {
+			q.scheduled = false
+			delete(p.partitions, q.key)
+		}
+	}
+}
+
+// workers exit once there are no ready partitions
+func (p *workerPool) stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	p.cond.Broadcast()
+}
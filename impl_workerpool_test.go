@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+	"github.com/voedger/voedger/pkg/istructs"
+)
+
+func TestWorkerPool_PartitionOrder(t *testing.T) {
+	require := require.New(t)
+	const queued = 5
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handled := []string{}
+	inProgress := 0
+	mu := sync.Mutex{}
+	b := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		mu.Lock()
+		inProgress++
+		require.Equal(1, inProgress, "requests of the same partition must not be handled simultaneously")
+		mu.Unlock()
+		if request.Resource == "blocker" {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		handled = append(handled, request.Resource)
+		inProgress--
+		mu.Unlock()
+		sender.SendResponse(ibus.Response{})
+	}, WithWorkerPool(queued, queued, nil)) // there are free workers while the partition is busy
+
+	wg := sync.WaitGroup{}
+	sendRequest := func(resource string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := b.SendRequest2(context.Background(), ibus.Request{PartitionID: 1, Resource: resource}, ibus.DefaultTimeout)
+			require.NoError(err)
+		}()
+	}
+	sendRequest("blocker")
+	<-started
+
+	// requests are submitted concurrently with the blocked one, each is queued before the next is sent
+	pool := b.(*bus).workerPool
+	expected := []string{"blocker"}
+	for i := 0; i < queued; i++ {
+		resource := strconv.Itoa(i)
+		expected = append(expected, resource)
+		sendRequest(resource)
+		require.Eventually(func() bool {
+			pool.Lock()
+			defer pool.Unlock()
+			return len(pool.partitions[1].tasks) == i+1
+		}, ibus.DefaultTimeout, time.Millisecond)
+	}
+
+	// free workers do not take queued requests of the busy partition
+	require.Never(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) > 0
+	}, 50*time.Millisecond, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	require.Equal(expected, handled)
+}
+
+func TestWorkerPool_Concurrency(t *testing.T) {
+	require := require.New(t)
+	const workers = 2
+	const requests = workers * 3
+	var current, max int32
+	release := make(chan struct{})
+	started := make(chan struct{}, requests)
+	bus := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		c := atomic.AddInt32(&current, 1)
+		for m := atomic.LoadInt32(&max); c > m && !atomic.CompareAndSwapInt32(&max, m, c); m = atomic.LoadInt32(&max) {
+		}
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&current, -1)
+		sender.SendResponse(ibus.Response{})
+	}, WithWorkerPool(workers, 10, PartitionKeyWSID))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(wsid istructs.WSID) {
+			defer wg.Done()
+			_, _, _, err := bus.SendRequest2(context.Background(), ibus.Request{WSID: wsid}, ibus.DefaultTimeout)
+			require.NoError(err)
+		}(istructs.WSID(i))
+	}
+	for i := 0; i < workers; i++ {
+		<-started
+	}
+	// all workers are busy -> other requests are not handled
+	require.Never(func() bool { return len(started) > 0 }, 50*time.Millisecond, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(int32(workers), atomic.LoadInt32(&max))
+}
+
+func TestWorkerPool_Busy(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	b := Provide(func(requestCtx context.Context, sender ibus.ISender, request ibus.Request) {
+		if request.Resource == "blocker" {
+			close(started)
+			<-release
+		}
+		sender.SendResponse(ibus.Response{Data: []byte(request.Resource)})
+	}, WithWorkerPool(2, 1, nil))
+
+	// the only worker of partition 1 is busy
+	blockerDone := make(chan struct{})
+	go func() {
+		defer close(blockerDone)
+		resp, _, _, err := b.SendRequest2(context.Background(), ibus.Request{PartitionID: 1, Resource: "blocker"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("blocker", string(resp.Data))
+	}()
+	<-started
+
+	// one request of partition 1 is queued
+	queuedDone := make(chan struct{})
+	go func() {
+		defer close(queuedDone)
+		resp, _, _, err := b.SendRequest2(context.Background(), ibus.Request{PartitionID: 1, Resource: "queued"}, ibus.DefaultTimeout)
+		require.NoError(err)
+		require.Equal("queued", string(resp.Data))
+	}()
+	pool := b.(*bus).workerPool
+	require.Eventually(func() bool {
+		pool.Lock()
+		defer pool.Unlock()
+		return len(pool.partitions[1].tasks) == 1
+	}, ibus.DefaultTimeout, time.Millisecond)
+
+	_, _, _, err := b.SendRequest2(context.Background(), ibus.Request{PartitionID: 1}, ibus.DefaultTimeout)
+	require.ErrorIs(err, ErrBusBusy)
+
+	// other partitions are not affected
+	resp, _, _, err := b.SendRequest2(context.Background(), ibus.Request{PartitionID: 2, Resource: "other"}, ibus.DefaultTimeout)
+	require.NoError(err)
+	require.Equal("other", string(resp.Data))
+
+	// the queued request waits for the blocker although the other worker is free
+	require.Never(func() bool { return isClosed(queuedDone) }, 50*time.Millisecond, time.Millisecond)
+
+	close(release)
+	<-blockerDone
+	<-queuedDone
+}
+
+func TestWorkerPool_Options(t *testing.T) {
+	require := require.New(t)
+	require.Panics(func() { WithWorkerPool(0, 1, nil) })
+	require.Panics(func() { WithWorkerPool(1, 0, nil) })
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2021-present unTill Pro, Ltd.
+ */
+
+package ibusmem
+
+import (
+	"context"
+	"io"
+	"time"
+
+	ibus "github.com/untillpro/airs-ibus"
+)
+
+// IBus is the in-memory ibus.IBus which could be shut down
+type IBus interface {
+	ibus.IBus
+
+	// Shutdown makes SendRequest2 to return ErrBusClosed and waits for in-flight requests: SendRequest2 calls,
+	// request handlers and sectioned responses which are not closed yet
+	// if ctx is done earlier then in-flight requests are cancelled as by Close and ctx.Err() is returned
+	Shutdown(ctx context.Context) error
+
+	// Close makes SendRequest2 to return ErrBusClosed and cancels in-flight requests without waiting for them:
+	// requestCtx of handlers is cancelled, pending SendRequest2 calls and sends of sections and elements fail with ErrBusClosed
+	Close() error
+}
+
+// IRouter dispatches requests to handlers by ibus.Request.Method and ibus.Request.Resource
+// HandleRequest has the request handler signature so the router is plugged into Provide as Provide(router.HandleRequest)
+type IRouter interface {
+	// resourcePattern is a list of segments separated by "/":
+	//   - "name" matches the segment as is
+	//   - "{param}" matches any single segment, the value is available as Route.Params["param"]
+	//   - "*" is allowed as the last segment only and matches the rest of the resource (could be empty), the value is available as Route.Params["*"]
+	// panics on invalid pattern, nil handler or if the route is registered already
+	Handle(method ibus.HTTPMethod, resourcePattern string, handler ibus.RequestHandler)
+
+	// the matched route is available for the handler through MatchedRoute(requestCtx)
+	// 404 response is sent if no route matches the request
+	HandleRequest(requestCtx context.Context, sender ibus.ISender, request ibus.Request)
+}
+
+// IMetricsCollector receives bus events, see WithMetrics
+// must be safe for concurrent use
+type IMetricsCollector interface {
+	// SendRequest2 is called
+	Request()
+
+	// request handler sent the single response
+	Response()
+
+	// request handler started the sectioned response
+	ParallelResponse()
+
+	// request handler panic is recovered in SendRequest2 or the producer panic is recovered by Go
+	Panic()
+
+	// SendRequest2 returned ibus.ErrBusTimeoutExpired
+	BusTimeout()
+
+	// section or element send failed with ibus.ErrNoConsumer
+	NoConsumer()
+
+	// section is sent to the client
+	Section(kind ibus.SectionKind, sectionType string)
+
+	// element of the section is sent to the client
+	Element(kind ibus.SectionKind, sectionType string)
+
+	// stream producer waits for the client to read the section or the element of the section, e.g. the flow-control window is full
+	ProducerBlocked(kind ibus.SectionKind, sectionType string)
+
+	// SendRequest2 call duration
+	RequestDuration(d time.Duration)
+
+	// duration between SendParallelResponse and Close of the sectioned response
+	StreamDuration(d time.Duration)
+}
+
+// IMetrics is the built-in IMetricsCollector implementation
+type IMetrics interface {
+	IMetricsCollector
+
+	// writes collected metrics in Prometheus text exposition format
+	WriteText(w io.Writer) error
+}
+
+// ITracer starts spans, see WithTracer
+// must be safe for concurrent use
+type ITracer interface {
+	// the parent span is taken from ctx by ParentSpanContext
+	// the returned ctx contains the started span, see ContextWithSpan
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, ISpan)
+}
+
+// ISpan is the traced operation started by ITracer
+type ISpan interface {
+	SpanContext() SpanContext
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+
+	// nil error is ignored
+	SetError(err error)
+	End()
+}
+
+// IInMemoryTracer is the ITracer which keeps ended spans in memory, useful for tests
+type IInMemoryTracer interface {
+	ITracer
+
+	// ended spans in order of End() calls
+	Spans() []SpanData
+	Reset()
+}
+
+// ICodec encodes elements of sections sent by IResultSender.SendElement and decodes them on the consumer side
+// []byte elements are sent as is, so they must be already encoded by the codec of the request, see RequestCodec
+type ICodec interface {
+	ContentType() string
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+// IClock is the source of time for the bus: request and stream durations, response, section and element timeouts,
+// admission queue wait and batch latency, see WithClock
+// must be safe for concurrent use
+type IClock interface {
+	Now() time.Time
+
+	// fires once d is elapsed, fires immediately if d is not positive
+	NewTimer(d time.Duration) ITimer
+
+	// calls f in its own goroutine once d is elapsed, ITimer.C() of the returned timer is nil
+	AfterFunc(d time.Duration, f func()) ITimer
+}
+
+// ITimer is the timer created by IClock
+// the stale fire is not received after Stop or Reset
+type ITimer interface {
+	C() <-chan time.Time
+
+	// returns false if the timer is fired or stopped already
+	Stop() bool
+
+	// returns false if the timer is fired or stopped already
+	Reset(d time.Duration) bool
+}
+
+// IManualClock is the IClock which time is moved forward by Advance only, useful for deterministic tests of timeouts
+type IManualClock interface {
+	IClock
+
+	// moves the time forward by d firing due timers in order of their deadlines
+	Advance(d time.Duration)
+
+	// waits until at least the given amount of timers is armed, e.g. sends of sections and elements wait for the consumer
+	BlockUntil(timers int)
+
+	// returns how many times timers are armed since the clock is created, the timer is counted again on each reset
+	Arms() int
+
+	// waits until timers are armed at least the given times since the clock is created, see Arms
+	// e.g. the element send waits for the consumer while the timer of the section send could be still armed
+	BlockUntilArms(arms int)
+}
+
+// ILogger receives messages logged by the bus, see WithLogger
+// must be safe for concurrent use
+type ILogger interface {
+	Error(args ...interface{})
+	Warning(args ...interface{})
+}
@@ -6,14 +6,39 @@ package ibusmem
 
 import (
 	"context"
+	"net/http"
 	"time"
 
 	ibus "github.com/untillpro/airs-ibus"
 )
 
 // requestCtx is already contained by sender but exposed also as a separate param because it is more useful in request handlers
-func Provide(requestHandler func(requestCtx context.Context, sender ibus.ISender, request ibus.Request)) ibus.IBus {
-	return provide(requestHandler, time.After, time.After, time.After)
+// requestCtx is cancelled once the client ctx is done, the bus is closed or the response timeout is expired
+// context.Cause(requestCtx) returns ErrClientDisconnected, ErrBusClosed or ibus.ErrBusTimeoutExpired accordingly
+// the bus is configured by options, e.g. WithClock, WithTimeouts, WithLogger, WithCodecs, WithWorkerPool, WithAdmissionControl, WithMiddleware, WithHooks, WithLimits, WithLeakDetection, WithSafeMode
+func Provide(requestHandler func(requestCtx context.Context, sender ibus.ISender, request ibus.Request), opts ...Option) IBus {
+	if requestHandler == nil {
+		panic("request handler must be not nil")
+	}
+	b := &bus{
+		requestHandler: requestHandler,
+		clock:          SystemClock,
+		metrics:        nopMetrics{},
+		codec:          CodecJSON,
+		codecs:         []ICodec{CodecJSON, CodecMsgPack, CodecCBOR},
+		logger:         defaultLogger{},
+		lifecycle: lifecycle{
+			scopes:  map[*requestScope]struct{}{},
+			drained: make(chan struct{}),
+			stop:    make(chan struct{}),
+		},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.requestHandler = Chain(b.requestHandler, b.middlewares...)
+	b.deadlines = newSendDeadlines(b.clock)
+	return b
 }
 
 func NewISender(bus ibus.IBus, sender interface{}) ibus.ISender {
@@ -23,18 +48,231 @@ func NewISender(bus ibus.IBus, sender interface{}) ibus.ISender {
 	}
 }
 
-func provide(requestHandler func(requestCtx context.Context, sender ibus.ISender, request ibus.Request),
-	timerResponse func(time.Duration) <-chan time.Time,
-	timerSection func(time.Duration) <-chan time.Time,
-	timerElement func(time.Duration) <-chan time.Time,
-) ibus.IBus {
-	if requestHandler == nil {
-		panic("request handler must be not nil")
+// routes are registered by IRouter.Handle, then the router is plugged into Provide as Provide(router.HandleRequest)
+func NewRouter() IRouter {
+	return &router{}
+}
+
+// WithWorkerPool makes the bus to call the request handler in one of the workers instead of the SendRequest2 caller goroutine
+// requests having the same partition key are handled one by one in order of SendRequest2 calls
+// SendRequest2 returns ErrBusBusy if there are maxQueueLen requests of the same partition waiting for a worker already
+// requests are partitioned by ibus.Request.PartitionID if partitionKey is nil
+func WithWorkerPool(workers int, maxQueueLen int, partitionKey func(request ibus.Request) uint64) Option {
+	if workers <= 0 || maxQueueLen <= 0 {
+		panic("workers amount and max queue length must be positive")
 	}
-	return &bus{
-		requestHandler: requestHandler,
-		timerResponse:  timerResponse,
-		timerSection:   timerSection,
-		timerElement:   timerElement,
+	if partitionKey == nil {
+		partitionKey = PartitionKeyPartitionID
+	}
+	return func(b *bus) {
+		b.workerPool = newWorkerPool(workers, maxQueueLen, partitionKey)
+	}
+}
+
+// WithAdmissionControl makes SendRequest2 to reject requests which exceed the in-flight limit with ErrBusOverloaded
+// instead of waiting for the handler until ErrBusTimeoutExpired
+func WithAdmissionControl(cfg AdmissionControl) Option {
+	if cfg.MaxInFlight <= 0 {
+		panic("max in-flight requests amount must be positive")
+	}
+	if cfg.MinInFlight <= 0 {
+		cfg.MinInFlight = 1
+	}
+	if cfg.MinInFlight > cfg.MaxInFlight {
+		panic("min in-flight requests amount must not exceed the max one")
+	}
+	if cfg.OverloadResponse == nil {
+		resp := ibus.CreateErrorResponse(http.StatusServiceUnavailable, ErrBusOverloaded)
+		cfg.OverloadResponse = &resp
+	}
+	return func(b *bus) {
+		b.admission = &admission{
+			cfg:   cfg,
+			limit: float64(cfg.MaxInFlight),
+		}
+	}
+}
+
+// WithMetrics makes the bus to report events to the collector, e.g. the one returned by NewMetrics
+func WithMetrics(collector IMetricsCollector) Option {
+	if collector == nil {
+		panic("metrics collector must be not nil")
+	}
+	return func(b *bus) {
+		b.metrics = collector
+	}
+}
+
+// NewMetrics returns the metrics collector which needs no external dependencies and exposes metrics in Prometheus text format
+func NewMetrics() IMetrics {
+	return &metrics{
+		requestDuration: newHistogram(durationBuckets),
+		streamDuration:  newHistogram(durationBuckets),
+	}
+}
+
+// WithTracer makes the bus to trace each SendRequest2 call and sections of parallel responses
+// trace context is propagated from the W3C traceparent request header to the requestCtx
+func WithTracer(tracer ITracer) Option {
+	if tracer == nil {
+		panic("tracer must be not nil")
+	}
+	return func(b *bus) {
+		b.tracer = tracer
+	}
+}
+
+// NewInMemoryTracer returns the tracer which keeps ended spans in memory
+func NewInMemoryTracer() IInMemoryTracer {
+	return &inMemoryTracer{}
+}
+
+// WithCodecs makes the bus to encode elements of sections by the default codec instead of CodecJSON
+// request could negotiate one of the default and negotiable codecs by the Accept header
+// all built-in codecs are negotiable by default, CodecJSON is the default one
+func WithCodecs(defaultCodec ICodec, negotiable ...ICodec) Option {
+	if defaultCodec == nil {
+		panic("default codec must be not nil")
+	}
+	codecs := []ICodec{defaultCodec}
+	for _, codec := range negotiable {
+		if codec == nil {
+			panic("codec must be not nil")
+		}
+		codecs = append(codecs, codec)
+	}
+	return func(b *bus) {
+		b.codec = defaultCodec
+		b.codecs = codecs
+	}
+}
+
+// WithElementBatching makes streams to deliver elements of array and map sections in batches instead of one by one
+// sections still return elements one by one, the batch is delivered once it is full, on MaxLatency, on the next section start or on Close
+// SendElement returns the delivery error of the batch, e.g. ibus.ErrNoConsumer, so the error could belong to one of previous elements
+func WithElementBatching(cfg ElementBatching) Option {
+	if cfg.MaxElements <= 0 {
+		panic("max batch elements amount must be positive")
+	}
+	if cfg.MaxBytes < 0 || cfg.MaxLatency < 0 {
+		panic("max batch size and latency must not be negative")
+	}
+	return func(b *bus) {
+		b.batching = &cfg
+	}
+}
+
+// WithFlowControl makes streams to send up to cfg.WindowElements sections and elements without waiting for the client to read them
+// so the producer is not blocked and ibus.ErrNoConsumer does not fire while the client pauses briefly
+// blocked producers are reported by IMetricsCollector.ProducerBlocked
+func WithFlowControl(cfg FlowControl) Option {
+	if cfg.WindowElements <= 0 {
+		panic("window elements amount must be positive")
+	}
+	if cfg.WindowBytes < 0 {
+		panic("window bytes must not be negative")
+	}
+	return func(b *bus) {
+		b.flowControl = &cfg
+	}
+}
+
+// WithClock makes the bus to take the time and timers from the clock instead of SystemClock, e.g. from the one returned by NewManualClock
+func WithClock(clock IClock) Option {
+	if clock == nil {
+		panic("clock must be not nil")
+	}
+	return func(b *bus) {
+		b.clock = clock
+	}
+}
+
+// NewManualClock returns the clock which shows now until it is moved forward by IManualClock.Advance
+func NewManualClock(now time.Time) IManualClock {
+	return newManualClock(now)
+}
+
+// WithLogger makes the bus to log e.g. handler panics by the logger instead of github.com/voedger/voedger/pkg/goutils/logger
+func WithLogger(logger ILogger) Option {
+	if logger == nil {
+		panic("logger must be not nil")
+	}
+	return func(b *bus) {
+		b.logger = logger
+	}
+}
+
+// WithMiddleware wraps the request handler with middlewares as Chain does
+// middlewares of the first WithMiddleware option are the outermost ones
+func WithMiddleware(middlewares ...Middleware) Option {
+	for _, m := range middlewares {
+		if m == nil {
+			panic("middleware must be not nil")
+		}
+	}
+	return func(b *bus) {
+		b.middlewares = append(b.middlewares, middlewares...)
+	}
+}
+
+// WithHooks makes the bus to call hooks on request and stream events
+// hooks of all WithHooks options are called in order of options
+func WithHooks(hooks Hooks) Option {
+	return func(b *bus) {
+		b.hooks = append(b.hooks, hooks)
+	}
+}
+
+// WithLimits makes section and element sends to return ErrLimitExceeded if the section or the element exceeds limits
+func WithLimits(limits Limits) Option {
+	if limits.MaxElementSize < 0 || limits.MaxSections < 0 {
+		panic("limits must not be negative")
+	}
+	return func(b *bus) {
+		b.limits = limits
+	}
+}
+
+// WithTimeouts makes SendRequest2 to use non-zero timeouts instead of the one provided to SendRequest2
+// timeouts could be overridden per request by ContextWithTimeouts
+func WithTimeouts(timeouts Timeouts) Option {
+	if timeouts.Response < 0 || timeouts.Section < 0 || timeouts.Element < 0 || timeouts.Stream < 0 {
+		panic("timeouts must not be negative")
+	}
+	return func(b *bus) {
+		b.timeouts = timeouts
+	}
+}
+
+// WithLeakDetection makes the bus to close streams which are not closed by the request handler with ErrStreamAbandoned
+// the stream is abandoned once it is idle for cfg.IdleTimeout or once it is garbage collected, e.g. the handler goroutine is finished
+// the stack of the stream creation is logged by ILogger.Warning
+func WithLeakDetection(cfg LeakDetection) Option {
+	if cfg.IdleTimeout < 0 {
+		panic("idle timeout must not be negative")
+	}
+	return func(b *bus) {
+		b.leakDetection = &cfg
+	}
+}
+
+// WithSafeMode makes senders to log the misuse and to return ErrProtocolViolation instead of panic
+// e.g. on the second response, on the element send before the section start or on calls after Close
+// calls which return nothing, e.g. SendResponse or StartArraySection, are ignored on the misuse
+// the misuse panics by default to fail tests fast
+func WithSafeMode() Option {
+	return func(b *bus) {
+		b.safeMode = true
+	}
+}
+
+// NewBusError returns the error which could be e.g. sent to the client by BusError.ToResponse or by IResultSenderClosable.Close
+// cause could be nil
+func NewBusError(status int, code string, message string, cause error) *BusError {
+	return &BusError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+		cause:   cause,
 	}
 }
@@ -5,7 +5,11 @@
 package ibusmem
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	ibus "github.com/untillpro/airs-ibus"
@@ -13,38 +17,118 @@ import (
 
 type bus struct {
 	requestHandler func(requestCtx context.Context, sender ibus.ISender, request ibus.Request)
-	timerResponse  func(d time.Duration) <-chan time.Time
-	timerSection   func(d time.Duration) <-chan time.Time
-	timerElement   func(d time.Duration) <-chan time.Time
+	clock          IClock
+	deadlines      *sendDeadlines
+	workerPool     *workerPool
+	admission      *admission
+	metrics        IMetricsCollector
+	tracer         ITracer // nil if tracing is off
+	lifecycle      lifecycle
+	codec          ICodec           // used if the request does not negotiate another one
+	codecs         []ICodec         // available for the negotiation by the Accept request header
+	batching       *ElementBatching // nil if elements are delivered one by one
+	flowControl    *FlowControl     // nil if sections and elements channels are unbuffered
+	logger         ILogger
+	middlewares    []Middleware // applied to the request handler by Provide
+	hooks          []Hooks
+	limits         Limits
+	timeouts       Timeouts       // zero ones are taken from SendRequest2
+	leakDetection  *LeakDetection // nil if abandoned streams are not detected
+	safeMode       bool           // misuse of senders returns ErrProtocolViolation instead of panic
 }
 
+// Option configures the bus returned by Provide
+// options are applied in order, so the latter option overrides the former one of the same kind,
+// except WithMiddleware and WithHooks which are accumulated
+type Option func(b *bus)
+
 type channelSender struct {
-	c         chan interface{}
-	timeout   time.Duration
-	clientCtx context.Context
+	c          chan interface{}
+	responded  atomic.Bool // the response or the sectioned response is sent already
+	request    ibus.Request
+	timeouts   Timeouts
+	clientCtx  context.Context
+	requestCtx context.Context // clientCtx + request span, cancelled on the bus close
+	scope      *requestScope
+	codec      ICodec
+	logger     ILogger
+	safeMode   bool
 }
 
+// guarded by the mutex since the stream could be closed by the deadline concurrently with sends
 type resultSenderClosable struct {
-	currentSection ibus.ISection
-	sections       chan ibus.ISection
-	elements       chan element
-	err            *error
-	timeout        time.Duration
-	clientCtx      context.Context // closed if client is e.g. disconnected
-	timerSection   func(d time.Duration) <-chan time.Time
-	timerElement   func(d time.Duration) <-chan time.Time
+	sync.Mutex
+	currentSection   ibus.ISection
+	sections         chan ibus.ISection
+	elements         chan element
+	err              *error
+	timeouts         Timeouts
+	clientCtx        context.Context // closed if client is e.g. disconnected
+	clock            IClock
+	deadlines        *sendDeadlines
+	timer            *streamTimer // reused by all sends of the stream, created on the first blocked send
+	metrics          IMetricsCollector
+	started          time.Time
+	sectionKind      ibus.SectionKind // kind of the current section, kept after the section is sent
+	sectionType      string
+	tracer           ITracer // nil if tracing is off
+	streamCtx        context.Context
+	streamSpan       ISpan
+	sectionSpan      ISpan // span of the current array or map section, ended on the next section start or Close
+	sectionElems     int
+	stop             <-chan struct{} // closed on the bus close
+	scope            *requestScope   // nil if the request is finished already on SendParallelResponse2
+	codec            ICodec
+	encoder          *elementEncoder // taken from the pool on the first pooled encoding, returned on Close
+	released         atomic.Bool     // set by ReleaseElement, elements are encoded into pooled buffers since then
+	batcher          *elementBatcher // nil if elements are delivered one by one
+	buffer           int             // capacity of sections, elements and batches channels
+	window           *flowWindow     // nil if there is no bytes window
+	requestCtx       context.Context
+	request          ibus.Request
+	logger           ILogger
+	safeMode         bool
+	hooks            []Hooks
+	limits           Limits
+	sentSections     int
+	deadline         ITimer        // nil if there is no stream deadline
+	deadlineExceeded chan struct{} // closed once the stream deadline is exceeded, nil if there is no stream deadline
+	closed           bool
+	abandoned        bool   // closed by the bus as abandoned
+	createdAt        []byte // stack of SendParallelResponse2 caller, nil if abandoned streams are not detected
+	idleTimeout      time.Duration
+	idleTimer        ITimer // nil if the idle stream is not closed
+	lastActivity     time.Time
+}
+
+// trackedSender is returned to the request handler instead of *resultSenderClosable if abandoned streams are detected
+// the stream is closed as abandoned once trackedSender is garbage collected not closed
+type trackedSender struct {
+	*resultSenderClosable
 }
 
 type arraySection struct {
 	sectionType string
 	path        []string
 	elems       chan element
+	batches     chan []element // nil if elements are delivered one by one
+	pending     []element      // rest of the received batch
+	window      *flowWindow    // received elements free the window of the producer, nil if there is no bytes window
+	codec       ICodec
+	last        *elementBuffer // buffer of the element returned by the last Next, see ReleaseElement
+	released    *atomic.Bool   // of the stream
 }
 
 type mapSection struct {
 	sectionType string
 	path        []string
 	elems       chan element
+	batches     chan []element
+	pending     []element
+	window      *flowWindow
+	codec       ICodec
+	last        *elementBuffer
+	released    *atomic.Bool
 }
 
 type objectSection struct {
@@ -52,14 +136,431 @@ type objectSection struct {
 	path            []string
 	elements        chan element
 	elementReceived bool
+	window          *flowWindow
+	codec           ICodec
+	last            *elementBuffer
+	released        *atomic.Bool
 }
 
 type element struct {
 	name  string
 	value []byte
+	buf   *elementBuffer // nil if the value is not pooled, e.g. []byte is sent as is
+}
+
+// small elements are encoded into the inline array, so the pooled buffer needs no allocation for the value
+type elementBuffer struct {
+	value  []byte
+	inline [elementBufferInlineSize]byte
+}
+
+// reused by the stream to encode elements by CodecJSON into pooled buffers once the consumer releases elements
+type elementEncoder struct {
+	buf *elementBuffer
+	enc *json.Encoder
 }
 
 type implISender struct {
 	bus    ibus.IBus
 	sender interface{}
 }
+
+// Route describes the route matched by IRouter
+type Route struct {
+	Method  ibus.HTTPMethod
+	Pattern string
+	Params  map[string]string
+}
+
+type router struct {
+	sync.RWMutex
+	routes []*route
+}
+
+type route struct {
+	method   ibus.HTTPMethod
+	pattern  string
+	segments []patternSegment
+	handler  ibus.RequestHandler
+}
+
+type patternSegment struct {
+	kind  segmentKind
+	value string
+}
+
+type segmentKind int
+
+type ctxKey int
+
+// Middleware wraps a request handler to add cross-cutting logic (auth, logging, metrics etc)
+// could call next or not, could wrap requestCtx, sender and request before passing them to next
+type Middleware func(next ibus.RequestHandler) ibus.RequestHandler
+
+// SenderInterceptor is used by InterceptSender middleware to intercept responses sent by wrapped handlers
+// nil func means no interception
+type SenderInterceptor struct {
+	// called instead of ISender.SendResponse, next is the sender provided to the middleware
+	SendResponse func(next ibus.ISender, resp ibus.Response)
+
+	// called instead of ISender.SendParallelResponse, next is the sender provided to the middleware
+	// the result sender returned is used by the wrapped handler, so sections and elements are intercepted by wrapping next.SendParallelResponse()
+	SendParallelResponse func(next ibus.ISender) ibus.IResultSenderClosable
+}
+
+type interceptingSender struct {
+	next        ibus.ISender
+	interceptor SenderInterceptor
+}
+
+type workerPool struct {
+	sync.Mutex
+	cond         *sync.Cond
+	partitionKey func(request ibus.Request) uint64
+	maxQueueLen  int
+	partitions   map[uint64]*partitionQueue
+	ready        []*partitionQueue // partitions having tasks and not being processed by a worker
+	stopped      bool
+}
+
+type partitionQueue struct {
+	key       uint64
+	tasks     []func()
+	scheduled bool // is in the ready list or is being processed by a worker
+}
+
+// AdmissionControl configures WithAdmissionControl
+type AdmissionControl struct {
+	// max amount of SendRequest2 calls processed simultaneously, must be positive
+	MaxInFlight int
+
+	// how long SendRequest2 waits for the in-flight slot, zero means the request is rejected immediately if there are no free slots
+	MaxQueueWait time.Duration
+
+	// non-zero means adaptive concurrency: the in-flight limit is decreased if SendRequest2 latency exceeds TargetLatency
+	// and slowly increased up to MaxInFlight otherwise
+	TargetLatency time.Duration
+
+	// the lowest in-flight limit for the adaptive concurrency, 1 is used if not positive
+	MinInFlight int
+
+	// returned by SendRequest2 along with ErrBusOverloaded, 503 Service Unavailable response is used if nil
+	OverloadResponse *ibus.Response
+}
+
+// deadlines of blocked sends shared by streams of the bus to not to create a runtime timer per stream or per send
+// the single timer of the clock is armed for the earliest deadline only while there are deadlines
+type sendDeadlines struct {
+	sync.Mutex
+	clock IClock
+	timer ITimer // created on the first deadline
+	queue deadlineQueue
+}
+
+// min-heap of armed stream timers by the deadline
+type deadlineQueue []*streamTimer
+
+// fires once its deadline is passed, reused by all sends of the stream
+type streamTimer struct {
+	c         chan time.Time // buffered by 1 to not to block the deadlines
+	deadlines *sendDeadlines
+	deadline  time.Time
+	index     int // in the queue, -1 if not armed
+}
+
+// ElementBatching configures WithElementBatching
+type ElementBatching struct {
+	// batch is delivered once it contains MaxElements elements, must be positive
+	MaxElements int
+
+	// non-zero means the batch is delivered once the total size of its element values reaches MaxBytes
+	MaxBytes int
+
+	// non-zero means the batch is delivered not later than MaxLatency after its first element is sent
+	// otherwise elements could wait for the batch to be full up to the section end
+	MaxLatency time.Duration
+}
+
+// elements of the current array or map section accumulated by the stream
+// guarded by the mutex since the batch is delivered also by the MaxLatency timer
+type elementBatcher struct {
+	sync.Mutex
+	cfg         ElementBatching
+	batches     chan []element // of the current array or map section, nil for the object section
+	pending     []element
+	pendingSize int
+	sectionKind ibus.SectionKind
+	sectionType string
+	timer       ITimer
+	err         error // delivery failure, e.g. ibus.ErrNoConsumer, returned by all further SendElement calls
+}
+
+// FlowControl configures WithFlowControl
+type FlowControl struct {
+	// amount of sections and elements which could be sent without waiting for the client to read them, must be positive
+	// batches are counted as elements if WithElementBatching is used
+	WindowElements int
+
+	// non-zero means the total size of element values sent but not read by the client is limited by WindowBytes
+	// the element larger than the window is sent once all previous elements are read
+	WindowBytes int
+}
+
+// bytes credit of the stream: taken by the producer on send, returned by the client on receive
+type flowWindow struct {
+	sync.Mutex
+	maxBytes int
+	bytes    int           // sent but not received yet
+	freed    chan struct{} // signalled on bytes return, buffered by 1 to not to lose the signal
+}
+
+type admission struct {
+	sync.Mutex
+	cfg      AdmissionControl
+	limit    float64
+	inFlight int
+	waiters  []chan struct{} // closed when the slot is granted
+}
+
+// Timeouts configures WithTimeouts and ContextWithTimeouts
+// zero means the timeout provided to SendRequest2 is used
+type Timeouts struct {
+	// how long SendRequest2 waits for the request handler to send the response or to start the sectioned response
+	Response time.Duration
+
+	// how long the send of the section waits for the client to read the previous section
+	Section time.Duration
+
+	// how long the send of the element waits for the client to read the previous element
+	Element time.Duration
+
+	// how long the sectioned response could be sent since it is started, zero means no deadline
+	// the timeout provided to SendRequest2 is not used for the stream deadline
+	// the stream is closed with ErrStreamDeadlineExceeded once the deadline is exceeded, further sends return ErrStreamDeadlineExceeded
+	Stream time.Duration
+}
+
+// Hooks configures WithHooks, nil func means no hook
+// hooks are called synchronously, so they must not block
+type Hooks struct {
+	// SendRequest2 is called and the bus is not closed, the request is not handled yet
+	OnRequest func(requestCtx context.Context, request ibus.Request)
+
+	// SendRequest2 is about to return, sections are not read yet if the sectioned response is started
+	OnRequestDone func(requestCtx context.Context, request ibus.Request, response ibus.Response, err error)
+
+	// the sectioned response is closed with err by the request handler, by Go once the producer returns
+	// or by the bus with *BusError caused by ErrStreamDeadlineExceeded or ErrStreamAbandoned
+	OnStreamClose func(requestCtx context.Context, err error)
+
+	// the panic of the request handler or of the producer run by Go is recovered
+	// SendRequest2 returns or the sectioned response is closed with *BusError caused by panicErr
+	OnPanic func(requestCtx context.Context, panicErr *PanicError)
+}
+
+// Limits configures WithLimits, zero means no limit
+type Limits struct {
+	// max size of the encoded element, SendElement and ObjectSection return ErrLimitExceeded for larger elements
+	MaxElementSize int
+
+	// max amount of sections of the sectioned response, sends of further sections return ErrLimitExceeded
+	MaxSections int
+}
+
+// LeakDetection configures WithLeakDetection
+type LeakDetection struct {
+	// the stream is closed as abandoned if no section or element is sent during it, zero means the idle stream is not closed
+	IdleTimeout time.Duration
+}
+
+type defaultLogger struct{}
+
+type systemClock struct{}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+type manualClock struct {
+	sync.Mutex
+	now          time.Time
+	armed        []*manualTimer // in order of arming
+	arms         int
+	armedChanged *sync.Cond
+}
+
+type manualTimer struct {
+	clock    *manualClock
+	deadline time.Time
+	c        chan time.Time // buffered by 1 to not to block Advance, nil for AfterFunc timers
+	f        func()
+}
+
+type nopMetrics struct{}
+
+type metrics struct {
+	requests          atomic.Uint64
+	responses         atomic.Uint64
+	parallelResponses atomic.Uint64
+	panics            atomic.Uint64
+	busTimeouts       atomic.Uint64
+	noConsumer        atomic.Uint64
+	sections          sync.Map // sectionKey -> *atomic.Uint64
+	elements          sync.Map // sectionKey -> *atomic.Uint64
+	producerBlocked   sync.Map // sectionKey -> *atomic.Uint64
+	requestDuration   histogram
+	streamDuration    histogram
+}
+
+type sectionKey struct {
+	kind        ibus.SectionKind
+	sectionType string
+}
+
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64 // counts[i] is amount of observations <= bounds[i], the last one is for +Inf
+	sum    float64
+	count  uint64
+}
+
+// TraceID is W3C Trace Context compatible trace identifier
+type TraceID [16]byte
+
+// SpanID is W3C Trace Context compatible span identifier
+type SpanID [8]byte
+
+// SpanContext identifies the span across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Attribute is a key-value pair attached to spans and span events
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// SpanData is the ended span recorded by IInMemoryTracer
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	Parent      SpanContext // zero if the span is the root one
+	Start       time.Time
+	End         time.Time
+	Attributes  []Attribute
+	Events      []SpanEvent
+	Err         error
+}
+
+// SpanEvent is the event added to the span
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+type inMemoryTracer struct {
+	sync.Mutex
+	spans []SpanData
+}
+
+type inMemorySpan struct {
+	sync.Mutex
+	tracer *inMemoryTracer
+	data   SpanData
+	ended  bool
+}
+
+type lifecycle struct {
+	sync.Mutex
+	closing bool
+	scopes  map[*requestScope]struct{} // in-flight requests
+	drained chan struct{}              // closed once closing and there are no in-flight requests
+	stop    chan struct{}              // closed on force close
+	stopped bool
+}
+
+// requestScope is in-flight until SendRequest2 returns, the request handler returns and the sectioned response is closed
+type requestScope struct {
+	bus    *bus
+	cancel context.CancelCauseFunc
+	refs   atomic.Int32
+}
+
+type sectionsCollector struct {
+	buf     bytes.Buffer
+	maxSize int
+}
+
+type jsonCodec struct{}
+
+type msgPackCodec struct{}
+
+type cborCodec struct{}
+
+// media range of the Accept header
+type acceptedMediaRange struct {
+	mediaRange string
+	quality    float64
+}
+
+// ArraySectionOf decodes elements of the array section into T lazily, see ArrayOf
+type ArraySectionOf[T any] struct {
+	section ibus.IArraySection
+	index   int
+	err     error
+}
+
+// MapSectionOf decodes elements of the map section into T lazily, see MapOf
+type MapSectionOf[T any] struct {
+	section ibus.IMapSection
+	index   int
+	err     error
+}
+
+// BusError is the structured error returned by the bus, e.g. by SendRequest2, section and element sends or as *secError
+// errors.Is(busErr, cause) is true, so errors.Is(err, ibus.ErrBusTimeoutExpired) works for the wrapped ibus.ErrBusTimeoutExpired
+// errors.Is(err, target) is also true for the *BusError target having the same Code
+type BusError struct {
+	Status  int    // HTTP status code
+	Code    string // machine readable code, e.g. ErrorCodeBusTimeout
+	Message string
+	Details map[string]interface{} // optional
+	cause   error
+}
+
+// PanicError is the cause of *BusError returned by SendRequest2 if the request handler panics, see errors.As
+// also the cause of *BusError set as *secError if the producer run by Go panics
+// the panic value is unwrapped if it is an error
+type PanicError struct {
+	Value   interface{} // recovered value
+	Stack   []byte      // stack of the panicked goroutine captured by debug.Stack()
+	Request ibus.Request
+}
+
+// JSON body of the response made by BusError.ToResponse
+type busErrorBody struct {
+	Status  int                    `json:"status"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// DecodeError is returned if a section element could not be decoded into the typed value
+type DecodeError struct {
+	SectionType string
+	Path        []string
+	Index       int    // index of the element in the section
+	Name        string // name of the map section element
+	Err         error
+}
+
+// violatedSender is returned by SendParallelResponse2 in the safe mode if the response is sent already
+// sends return the violation, other calls are ignored
+type violatedSender struct {
+	err error
+}